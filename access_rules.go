@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// errAccessDenied is what authenticate returns for signed in users that an
+// AccessRule refuses, who get a 403 rather than the sign in page
+var errAccessDenied = errors.New("access denied")
+
+// AccessRule restricts the requests it matches to users with one of the
+// Emails, an email in one of the Domains, or one of the Groups. A rule
+// without any of them lets every signed in user through.
+type AccessRule struct {
+	// Path matches the request path, nil matches every path
+	Path *regexp.Regexp
+	// Methods are the request methods matched, none matches every method
+	Methods []string
+	// Host is the request host matched, see matchHost. "" matches every
+	// host.
+	Host string
+
+	Emails  []string
+	Domains []string
+	Groups  []string
+}
+
+// parseAccessRule parses a rule given as URL query parameters, ie:
+// "path=^/admin/&method=POST&method=PUT&group=ops"
+func parseAccessRule(spec string) (*AccessRule, error) {
+	params, err := url.ParseQuery(spec)
+	if err != nil {
+		return nil, err
+	}
+	r := &AccessRule{}
+	for name, values := range params {
+		switch name {
+		case "path":
+			if r.Path, err = regexp.Compile(values[0]); err != nil {
+				return nil, err
+			}
+		case "method":
+			for _, method := range values {
+				r.Methods = append(r.Methods, strings.ToUpper(method))
+			}
+		case "host":
+			r.Host = strings.ToLower(values[0])
+		case "email":
+			r.Emails = append(r.Emails, values...)
+		case "domain":
+			for _, domain := range values {
+				r.Domains = append(r.Domains, strings.TrimPrefix(domain, "@"))
+			}
+		case "group":
+			r.Groups = append(r.Groups, values...)
+		default:
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	return r, nil
+}
+
+// Matches checks whether the rule applies to the request
+func (r *AccessRule) Matches(req *http.Request) bool {
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, method := range r.Methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks whether the session's user meets the rule's requirements
+func (r *AccessRule) Allows(s *providers.SessionState) bool {
+	if len(r.Emails) == 0 && len(r.Domains) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	email := strings.ToLower(s.Email)
+	for _, allowed := range r.Emails {
+		if email != "" && email == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	for _, domain := range r.Domains {
+		if email != "" && strings.HasSuffix(email, "@"+strings.ToLower(domain)) {
+			return true
+		}
+	}
+	for _, group := range s.Groups {
+		for _, allowed := range r.Groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchHost checks whether the host, which may have a port, matches the
+// pattern: a host name, or "*." followed by a domain to match any host
+// below that domain
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
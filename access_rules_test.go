@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccessRule(t *testing.T) {
+	r, err := parseAccessRule("path=^/admin/&method=post&method=PUT&host=*.Example.com" +
+		"&email=a@example.com&domain=@example.com&group=ops&group=admins")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "^/admin/", r.Path.String())
+	assert.Equal(t, []string{"POST", "PUT"}, r.Methods)
+	assert.Equal(t, "*.example.com", r.Host)
+	assert.Equal(t, []string{"a@example.com"}, r.Emails)
+	assert.Equal(t, []string{"example.com"}, r.Domains)
+	assert.Equal(t, []string{"ops", "admins"}, r.Groups)
+
+	_, err = parseAccessRule("path=(")
+	assert.NotEqual(t, nil, err)
+	_, err = parseAccessRule("group=ops&role=admin")
+	assert.Equal(t, `unknown parameter "role"`, err.Error())
+}
+
+func TestAccessRuleMatches(t *testing.T) {
+	r, _ := parseAccessRule("path=^/admin/&method=POST&host=*.example.com")
+	for _, tc := range []struct {
+		method, url string
+		expected    bool
+	}{
+		{"POST", "http://app.example.com/admin/users", true},
+		{"POST", "http://app.example.com:8080/admin/users", true},
+		{"POST", "http://APP.EXAMPLE.COM/admin/users", true},
+		{"GET", "http://app.example.com/admin/users", false},
+		{"POST", "http://app.example.com/users", false},
+		{"POST", "http://example.com/admin/users", false},
+		{"POST", "http://app.example.org/admin/users", false},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		assert.Equal(t, tc.expected, r.Matches(req), tc.method+" "+tc.url)
+	}
+
+	r, _ = parseAccessRule("")
+	req, _ := http.NewRequest("DELETE", "http://anything/", nil)
+	assert.Equal(t, true, r.Matches(req))
+}
+
+func TestAccessRuleAllows(t *testing.T) {
+	r, _ := parseAccessRule("email=Boss@example.org&domain=example.com&group=ops")
+	assert.Equal(t, true, r.Allows(&providers.SessionState{Email: "boss@example.org"}))
+	assert.Equal(t, true, r.Allows(&providers.SessionState{Email: "michael.bland@EXAMPLE.com"}))
+	assert.Equal(t, true, r.Allows(&providers.SessionState{User: "mbland", Groups: []string{"users", "ops"}}))
+	assert.Equal(t, false, r.Allows(&providers.SessionState{Email: "michael.bland@notexample.com"}))
+	assert.Equal(t, false, r.Allows(&providers.SessionState{Email: "michael.bland@example.org", Groups: []string{"users"}}))
+
+	r, _ = parseAccessRule("path=^/")
+	assert.Equal(t, true, r.Allows(&providers.SessionState{User: "mbland"}))
+}
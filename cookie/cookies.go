@@ -6,8 +6,10 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"strconv"
@@ -15,17 +17,52 @@ import (
 	"time"
 )
 
-// cookies are stored in a 3 part (value + timestamp + signature) to enforce that the values are as originally set.
+// cookies are stored in a 4 part (version + value + timestamp + signature) to enforce that the values are as originally set.
 // additionally, the 'value' is encrypted so it's opaque to the browser
+//
+// v1 cookies had no version part and were signed with HMAC-SHA1. They are
+// still accepted so that existing sessions survive an upgrade; new cookies
+// are always v2, signed with HMAC-SHA256.
+
+const cookieVersion = "v2"
 
 // Validate ensures a cookie is properly signed
 func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value string, t time.Time, ok bool) {
-	// value, timestamp, sig
+	value, t, _, ok = ValidateSeeds(cookie, []string{seed}, expiration)
+	return
+}
+
+// ValidateSeeds ensures a cookie is properly signed by one of seeds. stale
+// reports whether the cookie should be re-issued, because it was signed by
+// a seed other than the first one or is in the v1 format.
+func ValidateSeeds(cookie *http.Cookie, seeds []string, expiration time.Duration) (value string, t time.Time, stale bool, ok bool) {
+	for i, seed := range seeds {
+		var version string
+		value, t, version, ok = validate(cookie, seed, expiration)
+		if ok {
+			stale = i > 0 || version != cookieVersion
+			return
+		}
+	}
+	return
+}
+
+func validate(cookie *http.Cookie, seed string, expiration time.Duration) (value string, t time.Time, version string, ok bool) {
 	parts := strings.Split(cookie.Value, "|")
-	if len(parts) != 3 {
+	var sig string
+	switch {
+	case len(parts) == 4 && parts[0] == cookieVersion:
+		// version, value, timestamp, sig
+		version = parts[0]
+		sig = cookieSignature(sha256.New, seed, parts[0], cookie.Name, parts[1], parts[2])
+		parts = parts[1:]
+	case len(parts) == 3:
+		// v1: value, timestamp, sig
+		version = "v1"
+		sig = cookieSignature(sha1.New, seed, cookie.Name, parts[0], parts[1])
+	default:
 		return
 	}
-	sig := cookieSignature(seed, cookie.Name, parts[0], parts[1])
 	if checkHmac(parts[2], sig) {
 		ts, err := strconv.Atoi(parts[1])
 		if err != nil {
@@ -53,13 +90,13 @@ func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value
 func SignedValue(seed string, key string, value string, now time.Time) string {
 	encodedValue := base64.URLEncoding.EncodeToString([]byte(value))
 	timeStr := fmt.Sprintf("%d", now.Unix())
-	sig := cookieSignature(seed, key, encodedValue, timeStr)
-	cookieVal := fmt.Sprintf("%s|%s|%s", encodedValue, timeStr, sig)
+	sig := cookieSignature(sha256.New, seed, cookieVersion, key, encodedValue, timeStr)
+	cookieVal := fmt.Sprintf("%s|%s|%s|%s", cookieVersion, encodedValue, timeStr, sig)
 	return cookieVal
 }
 
-func cookieSignature(args ...string) string {
-	h := hmac.New(sha1.New, []byte(args[0]))
+func cookieSignature(signer func() hash.Hash, args ...string) string {
+	h := hmac.New(signer, []byte(args[0]))
 	for _, arg := range args[1:] {
 		h.Write([]byte(arg))
 	}
@@ -79,35 +116,84 @@ func checkHmac(input, expected string) bool {
 	return false
 }
 
+// encryptedPrefix marks values encrypted with AES-GCM. Values without it
+// were encrypted with AES-CFB by older versions and are decrypted as such.
+const encryptedPrefix = cookieVersion + ":"
+
 // Cipher provides methods to encrypt and decrypt cookie values
 type Cipher struct {
 	cipher.Block
+	aead cipher.AEAD
+	// old holds ciphers for previous secrets, only used to decrypt
+	old []*Cipher
 }
 
-// NewCipher returns a new aes Cipher for encrypting cookie values
-func NewCipher(secret []byte) (*Cipher, error) {
+// NewCipher returns a new aes Cipher for encrypting cookie values. Values
+// encrypted with any of oldSecrets can still be decrypted.
+func NewCipher(secret []byte, oldSecrets ...[]byte) (*Cipher, error) {
 	c, err := aes.NewCipher(secret)
 	if err != nil {
 		return nil, err
 	}
-	return &Cipher{Block: c}, err
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	ci := &Cipher{Block: c, aead: aead}
+	for _, secret := range oldSecrets {
+		old, err := NewCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+		ci.old = append(ci.old, old)
+	}
+	return ci, nil
 }
 
 // Encrypt a value for use in a cookie
 func (c *Cipher) Encrypt(value string) (string, error) {
-	ciphertext := make([]byte, aes.BlockSize+len(value))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", fmt.Errorf("failed to create initialization vector %s", err)
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce %s", err)
 	}
 
-	stream := cipher.NewCFBEncrypter(c.Block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], []byte(value))
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	ciphertext := c.aead.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
 // Decrypt a value from a cookie to it's original string
 func (c *Cipher) Decrypt(s string) (string, error) {
+	if !strings.HasPrefix(s, encryptedPrefix) {
+		return c.decryptCFB(s)
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(encrypted) < nonceSize {
+		return "", fmt.Errorf("encrypted cookie value should be "+
+			"at least %d bytes, but is only %d bytes",
+			nonceSize, len(encrypted))
+	}
+
+	value, err := c.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], nil)
+	for _, old := range c.old {
+		if err == nil {
+			break
+		}
+		value, err = old.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], nil)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+	}
+	return string(value), nil
+}
+
+// decryptCFB decrypts values encrypted with AES-CFB by v1 cookies. CFB
+// can't tell a wrong key apart, so only the current secret is used.
+func (c *Cipher) decryptCFB(s string) (string, error) {
 	encrypted, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
 		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
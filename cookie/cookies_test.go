@@ -1,8 +1,17 @@
 package cookie
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -40,3 +49,130 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestDecryptTamperedValue(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	c, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+	assert.True(t, strings.HasPrefix(encoded, "v2:"))
+
+	raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "v2:"))
+	raw[len(raw)-1] ^= 1
+	_, err = c.Decrypt("v2:" + base64.StdEncoding.EncodeToString(raw))
+	assert.NotEqual(t, nil, err)
+
+	other, err := NewCipher([]byte("0000000000abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+	_, err = other.Decrypt(encoded)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecryptLegacyCFBValue(t *testing.T) {
+	const secret = "0123456789abcdefghijklmnopqrstuv"
+	const token = "my access token"
+	c, err := NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+
+	// encrypted the way v1 cookies were
+	ciphertext := make([]byte, aes.BlockSize+len(token))
+	iv := ciphertext[:aes.BlockSize]
+	io.ReadFull(rand.Reader, iv)
+	cipher.NewCFBEncrypter(c.Block, iv).XORKeyStream(ciphertext[aes.BlockSize:], []byte(token))
+
+	decoded, err := c.Decrypt(base64.StdEncoding.EncodeToString(ciphertext))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, token, decoded)
+}
+
+func TestSignedValueRoundTrip(t *testing.T) {
+	now := time.Now()
+	value := SignedValue("seed", "_oauth2_proxy", "my value", now)
+	assert.True(t, strings.HasPrefix(value, "v2|"))
+	assert.Equal(t, 3, strings.Count(value, "|"))
+
+	c := &http.Cookie{Name: "_oauth2_proxy", Value: value}
+	v, ts, ok := Validate(c, "seed", time.Hour)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "my value", v)
+	assert.Equal(t, now.Unix(), ts.Unix())
+
+	_, _, ok = Validate(c, "other seed", time.Hour)
+	assert.Equal(t, false, ok)
+
+	c.Name = "_other_cookie"
+	_, _, ok = Validate(c, "seed", time.Hour)
+	assert.Equal(t, false, ok)
+}
+
+func TestValidateLegacyV1Cookie(t *testing.T) {
+	now := time.Now()
+	encoded := base64.URLEncoding.EncodeToString([]byte("my value"))
+	timeStr := fmt.Sprintf("%d", now.Unix())
+	sig := cookieSignature(sha1.New, "seed", "_oauth2_proxy", encoded, timeStr)
+	c := &http.Cookie{
+		Name:  "_oauth2_proxy",
+		Value: fmt.Sprintf("%s|%s|%s", encoded, timeStr, sig),
+	}
+
+	v, _, ok := Validate(c, "seed", time.Hour)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "my value", v)
+
+	// a v1 signature doesn't validate a v2 cookie
+	c.Value = fmt.Sprintf("v2|%s|%s|%s", encoded, timeStr, sig)
+	_, _, ok = Validate(c, "seed", time.Hour)
+	assert.Equal(t, false, ok)
+}
+
+func TestValidateSeeds(t *testing.T) {
+	now := time.Now()
+	c := &http.Cookie{
+		Name:  "_oauth2_proxy",
+		Value: SignedValue("old seed", "_oauth2_proxy", "my value", now),
+	}
+
+	v, _, stale, ok := ValidateSeeds(c, []string{"new seed", "old seed"}, time.Hour)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, stale)
+	assert.Equal(t, "my value", v)
+
+	_, _, stale, ok = ValidateSeeds(c, []string{"old seed", "new seed"}, time.Hour)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, false, stale)
+
+	_, _, _, ok = ValidateSeeds(c, []string{"new seed"}, time.Hour)
+	assert.Equal(t, false, ok)
+}
+
+func TestDecryptWithOldSecret(t *testing.T) {
+	oldSecret := []byte("0123456789abcdefghijklmnopqrstuv")
+	old, err := NewCipher(oldSecret)
+	assert.Equal(t, nil, err)
+	encoded, err := old.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+
+	c, err := NewCipher([]byte("0000000000abcdefghijklmnopqrstuv"), oldSecret)
+	assert.Equal(t, nil, err)
+	decoded, err := c.Decrypt(encoded)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my access token", decoded)
+
+	// new values are encrypted with the first secret only
+	encoded, err = c.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+	_, err = old.Decrypt(encoded)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// example from RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+
+	verifier, err := CodeVerifier()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 43, len(verifier))
+}
@@ -2,6 +2,8 @@ package cookie
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 )
 
@@ -14,3 +16,20 @@ func Nonce() (nonce string, err error) {
 	nonce = fmt.Sprintf("%x", b)
 	return
 }
+
+// CodeVerifier returns a random PKCE code_verifier (RFC 7636)
+func CodeVerifier() (verifier string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
+
+// CodeChallenge returns the S256 PKCE code_challenge for verifier
+func CodeChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
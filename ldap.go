@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"gopkg.in/ldap.v3"
+)
+
+// LDAPAuthenticator checks user names and passwords against an LDAP server.
+// It searches for the user's entry, bound as BindDN if there is one, and
+// then binds as that entry with the password.
+type LDAPAuthenticator struct {
+	// URL is the ldap:// or ldaps:// address of the server
+	URL       *url.URL
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	BindDN       string
+	BindPassword string
+
+	// UserFilter finds the user's entry below BaseDN, "%s" is replaced by
+	// the user name. The user's email is their EmailAttribute.
+	BaseDN         string
+	UserFilter     string
+	EmailAttribute string
+
+	// GroupFilter finds the user's groups below GroupBaseDN, "%s" is
+	// replaced by the user's DN, and the groups are named by their
+	// GroupAttribute. Without a GroupBaseDN the groups are the DNs in the
+	// user's memberOf attribute.
+	GroupBaseDN    string
+	GroupFilter    string
+	GroupAttribute string
+}
+
+// Authenticate returns a session with the user's email and groups if the
+// password is theirs
+func (a *LDAPAuthenticator) Authenticate(user, password string) (*providers.SessionState, error) {
+	// binding without a password is an unauthenticated bind, which succeeds
+	if user == "" || password == "" {
+		return nil, errors.New("missing user name or password")
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := a.serviceBind(conn); err != nil {
+		return nil, err
+	}
+	attributes := []string{"dn", a.EmailAttribute}
+	if a.GroupBaseDN == "" {
+		attributes = append(attributes, "memberOf")
+	}
+	entries, err := a.search(conn, a.BaseDN, a.UserFilter, user, attributes)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("found %d ldap entries for %q", len(entries), user)
+	}
+	entry := entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, fmt.Errorf("ldap bind as %q failed: %v", entry.DN, err)
+	}
+
+	s := &providers.SessionState{
+		User:  user,
+		Email: entry.GetAttributeValue(a.EmailAttribute),
+	}
+	if a.GroupBaseDN == "" {
+		s.Groups = entry.GetAttributeValues("memberOf")
+		return s, nil
+	}
+
+	// search for the groups as the service account again, the user may not
+	// be allowed to
+	if err := a.serviceBind(conn); err != nil {
+		return nil, err
+	}
+	groups, err := a.search(conn, a.GroupBaseDN, a.GroupFilter, entry.DN, []string{a.GroupAttribute})
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if name := group.GetAttributeValue(a.GroupAttribute); name != "" {
+			s.Groups = append(s.Groups, name)
+		}
+	}
+	return s, nil
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	host := a.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if a.URL.Scheme == "ldaps" {
+			host = net.JoinHostPort(host, "636")
+		} else {
+			host = net.JoinHostPort(host, "389")
+		}
+	}
+	tlsConfig := a.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: a.URL.Hostname()}
+	}
+
+	if a.URL.Scheme == "ldaps" {
+		return ldap.DialTLS("tcp", host, tlsConfig)
+	}
+	conn, err := ldap.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if a.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// serviceBind binds as the BindDN, if there is one, and stays anonymous
+// otherwise
+func (a *LDAPAuthenticator) serviceBind(conn *ldap.Conn) error {
+	if a.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+		return fmt.Errorf("ldap bind as %q failed: %v", a.BindDN, err)
+	}
+	return nil
+}
+
+// search returns the entries below baseDN matching filter, with "%s" in it
+// replaced by the escaped value
+func (a *LDAPAuthenticator) search(conn *ldap.Conn, baseDN, filter, value string, attributes []string) ([]*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		strings.Replace(filter, "%s", ldap.EscapeFilter(value), -1),
+		attributes, nil)
+	r, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("ldap search for %q failed: %v", req.Filter, err)
+	}
+	return r.Entries, nil
+}
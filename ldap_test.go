@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v3"
+)
+
+type ldapTestEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+// ldapTestServer is an in-process LDAP server answering simple binds and
+// searches with equality, presence, and/or filters. Searching needs a bind.
+type ldapTestServer struct {
+	listener net.Listener
+	entries  map[string]ldapTestEntry
+}
+
+func newLDAPTestServer() *ldapTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &ldapTestServer{
+		listener: l,
+		entries: map[string]ldapTestEntry{
+			"cn=proxy,dc=example,dc=com": {password: "proxy-secret"},
+			"uid=mbland,ou=people,dc=example,dc=com": {
+				password: "mbland-secret",
+				attributes: map[string][]string{
+					"uid":      {"mbland"},
+					"mail":     {"michael.bland@gsa.gov"},
+					"memberOf": {"cn=admins,ou=groups,dc=example,dc=com"},
+				},
+			},
+			"uid=jdoe,ou=people,dc=example,dc=com": {
+				password:   "jdoe-secret",
+				attributes: map[string][]string{"uid": {"jdoe"}},
+			},
+			"cn=admins,ou=groups,dc=example,dc=com": {
+				attributes: map[string][]string{
+					"cn":     {"admins"},
+					"member": {"uid=mbland,ou=people,dc=example,dc=com"},
+				},
+			},
+			"cn=ops,ou=groups,dc=example,dc=com": {
+				attributes: map[string][]string{
+					"cn":     {"ops"},
+					"member": {"uid=mbland,ou=people,dc=example,dc=com", "uid=jdoe,ou=people,dc=example,dc=com"},
+				},
+			},
+		},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapTestServer) URL() *url.URL {
+	return &url.URL{Scheme: "ldap", Host: s.listener.Addr().String()}
+}
+
+func (s *ldapTestServer) Close() {
+	s.listener.Close()
+}
+
+func (s *ldapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			entry, ok := s.entries[dn]
+			bound = ok && password != "" && entry.password == password
+			code := ldap.LDAPResultSuccess
+			if !bound {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapTestResponse(id, ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if !bound {
+				conn.Write(ldapTestResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			baseDN := op.Children[0].Value.(string)
+			for dn, entry := range s.entries {
+				if strings.HasSuffix(dn, ","+baseDN) && ldapTestMatch(op.Children[6], entry.attributes) {
+					conn.Write(ldapTestSearchEntry(id, dn, entry.attributes))
+				}
+			}
+			conn.Write(ldapTestResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func ldapTestMatch(filter *ber.Packet, attributes map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !ldapTestMatch(child, attributes) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if ldapTestMatch(child, attributes) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		for _, value := range attributes[filter.Children[0].Value.(string)] {
+			if value == filter.Children[1].Value.(string) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attributes[filter.Data.String()]) > 0
+	}
+	return false
+}
+
+func ldapTestMessage(id interface{}, op *ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapTestResponse(id interface{}, tag ber.Tag, code int) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return ldapTestMessage(id, op)
+}
+
+func ldapTestSearchEntry(id interface{}, dn string, attributes map[string][]string) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+	list := ber.NewSequence("attributes")
+	for name, values := range attributes {
+		attribute := ber.NewSequence("attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attribute.AppendChild(set)
+		list.AppendChild(attribute)
+	}
+	op.AppendChild(list)
+	return ldapTestMessage(id, op)
+}
+
+func testLDAPAuthenticator(s *ldapTestServer) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		URL:            s.URL(),
+		BindDN:         "cn=proxy,dc=example,dc=com",
+		BindPassword:   "proxy-secret",
+		BaseDN:         "ou=people,dc=example,dc=com",
+		UserFilter:     "(uid=%s)",
+		EmailAttribute: "mail",
+		GroupFilter:    "(member=%s)",
+		GroupAttribute: "cn",
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s := newLDAPTestServer()
+	defer s.Close()
+	a := testLDAPAuthenticator(s)
+
+	session, err := a.Authenticate("mbland", "mbland-secret")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", session.User)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	assert.Equal(t, []string{"cn=admins,ou=groups,dc=example,dc=com"}, session.Groups)
+
+	_, err = a.Authenticate("mbland", "wrong")
+	assert.NotEqual(t, nil, err)
+	_, err = a.Authenticate("mbland", "")
+	assert.Equal(t, "missing user name or password", err.Error())
+	_, err = a.Authenticate("nobody", "mbland-secret")
+	assert.Equal(t, `found 0 ldap entries for "nobody"`, err.Error())
+	// the user name can't change the filter
+	_, err = a.Authenticate("*", "mbland-secret")
+	assert.Equal(t, `found 0 ldap entries for "*"`, err.Error())
+}
+
+func TestLDAPAuthenticateServiceBind(t *testing.T) {
+	s := newLDAPTestServer()
+	defer s.Close()
+	a := testLDAPAuthenticator(s)
+
+	a.BindPassword = "wrong"
+	_, err := a.Authenticate("mbland", "mbland-secret")
+	assert.NotEqual(t, nil, err)
+
+	// searching anonymously isn't allowed
+	a.BindDN = ""
+	_, err = a.Authenticate("mbland", "mbland-secret")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLDAPAuthenticateGroupSearch(t *testing.T) {
+	s := newLDAPTestServer()
+	defer s.Close()
+	a := testLDAPAuthenticator(s)
+	a.GroupBaseDN = "ou=groups,dc=example,dc=com"
+
+	session, err := a.Authenticate("jdoe", "jdoe-secret")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", session.Email)
+	assert.Equal(t, []string{"ops"}, session.Groups)
+
+	a.GroupFilter = "(&(objectClass=*)(member=%s))"
+	session, err = a.Authenticate("jdoe", "jdoe-secret")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string(nil), session.Groups)
+}
+
+func TestLDAPBasicAuth(t *testing.T) {
+	s := newLDAPTestServer()
+	defer s.Close()
+	a := testLDAPAuthenticator(s)
+	a.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	p := &OAuthProxy{
+		LDAPAuthenticator: a,
+		Validator:         func(email string) bool { return strings.HasSuffix(email, "@gsa.gov") },
+		allowedGroups:     []string{"admins"},
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("mbland", "mbland-secret")
+	session, err := p.CheckBasicAuth(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	sort.Strings(session.Groups)
+	assert.Equal(t, []string{"admins", "ops"}, session.Groups)
+
+	// jdoe isn't an admin
+	req.SetBasicAuth("jdoe", "jdoe-secret")
+	session, err = p.CheckBasicAuth(req)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*providers.SessionState)(nil), session)
+
+	p.Validator = func(string) bool { return false }
+	req.SetBasicAuth("mbland", "mbland-secret")
+	_, err = p.CheckBasicAuth(req)
+	assert.Equal(t, `Permission Denied: "michael.bland@gsa.gov" is unauthorized`, err.Error())
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -61,6 +63,33 @@ func (l *responseLogger) WriteHeader(s int) {
 	l.status = s
 }
 
+// Hijack hands the connection over to the handler, ie: to tunnel a
+// WebSocket, which is logged with the 101 Switching Protocols status
+func (l *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := l.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.Hijacker is not available on writer")
+	}
+	l.ExtractGAPMetadata()
+	conn, rw, err := hj.Hijack()
+	if err == nil && l.status == 0 {
+		l.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Flush sends the buffered response to the client, ie: for streamed
+// responses
+func (l *responseLogger) Flush() {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	l.ExtractGAPMetadata()
+	if f, ok := l.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (l *responseLogger) Status() int {
 	return l.status
 }
@@ -7,6 +7,8 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLoggingHandler_ServeHTTP(t *testing.T) {
@@ -40,3 +42,27 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestResponseLoggerFlushAndHijack(t *testing.T) {
+	rw := httptest.NewRecorder()
+	l := &responseLogger{w: rw}
+	l.Header().Set("GAP-Upstream-Address", "127.0.0.1:8080")
+	l.Flush()
+	assert.Equal(t, true, rw.Flushed)
+	assert.Equal(t, http.StatusOK, l.Status())
+	assert.Equal(t, "127.0.0.1:8080", l.upstream)
+
+	// the recorder can't be hijacked
+	_, _, err := l.Hijack()
+	assert.NotEqual(t, nil, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l := &responseLogger{w: w}
+		conn, _, err := l.Hijack()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, l.Status())
+		conn.Close()
+	}))
+	defer server.Close()
+	http.Get(server.URL)
+}
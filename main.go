@@ -21,6 +21,18 @@ func main() {
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
 	googleGroups := StringArray{}
+	githubUsers := StringArray{}
+	gitlabGroups := StringArray{}
+	gitlabProjects := StringArray{}
+	keycloakGroups := StringArray{}
+	keycloakRoles := StringArray{}
+	whitelistDomains := StringArray{}
+	allowedGroups := StringArray{}
+	extraJwtIssuers := StringArray{}
+	extraProviders := StringArray{}
+	accessRules := StringArray{}
+	virtualHosts := StringArray{}
+	cookieSecretsOld := StringArray{}
 
 	config := flagSet.String("config", "", "path to config file")
 	showVersion := flagSet.Bool("version", false, "print version string")
@@ -31,7 +43,10 @@ func main() {
 	flagSet.String("tls-key", "", "path to private key file")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
 	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
+	flagSet.Bool("auth-request-original-uri", false, "match access rules for /oauth2/auth requests against the X-Original-URI or X-Forwarded-Uri and X-Original-Method or X-Forwarded-Method headers (only behind a proxy that always sets them)")
 	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
+	flagSet.String("upstreams-file", "", "path to a TOML file of [[upstream]] tables with per upstream options")
+	flagSet.Var(&virtualHosts, "virtual-host", "route requests for host=<host> (*.<domain> for any host below it) to its own upstream=<url> values, restricted to users with one of its email=, domain= or group= values, as query parameters (may be given multiple times)")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
@@ -40,44 +55,85 @@ func main() {
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Bool("skip-jwt-bearer-tokens", false, "will skip the login for requests with an \"Authorization: Bearer\" JWT verified by the oidc-issuer-url or one of the extra-jwt-issuers")
+	flagSet.Var(&extraJwtIssuers, "extra-jwt-issuers", "other trusted issuers of bearer JWTs, as issuer=audience (may be given multiple times)")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
 
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.Var(&allowedGroups, "allowed-group", "restrict logins to members of this group, as reported by the provider (may be given multiple times)")
+	flagSet.Var(&accessRules, "access-rule", "restrict requests matching path=<regex>, method=<method> and host=<host> to users with one of the given email=, domain= or group= values, as query parameters; the first matching rule applies (may be given multiple times)")
+	flagSet.Var(&whitelistDomains, "whitelist-domain", "allowed domains for absolute rd redirects after sign in or sign out (may be given multiple times). Prefix with . to allow subdomains")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.Bool("azure-v2", false, "use the Azure AD v2.0 endpoints, verifying id_tokens and reading groups from Microsoft Graph")
+	flagSet.String("generic-userinfo-method", "", "the HTTP method of the generic provider's profile-url requests: GET or POST")
+	flagSet.String("generic-auth-style", "", "how the generic provider passes the access token to the profile-url: bearer, token (Authorization header) or query (access_token parameter)")
+	flagSet.String("generic-email-path", "", "the generic provider's selector of the email in the profile-url JSON, ie: data.emails.0.value (default \"email\")")
+	flagSet.String("generic-user-path", "", "the generic provider's selector of the username in the profile-url JSON")
+	flagSet.String("generic-groups-path", "", "the generic provider's selector of the groups in the profile-url JSON, ie: memberships.*.name")
+	flagSet.String("github-base-url", "", "the base URL of a GitHub Enterprise server the endpoints are derived from, ie: https://github.example.com")
 	flagSet.String("github-org", "", "restrict logins to members of this organisation")
 	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.String("github-repo", "", "restrict logins to collaborators of this repository, as <owner>/<repo>")
+	flagSet.Var(&githubUsers, "github-user", "allow logins by this github user, regardless of the other github restrictions (may be given multiple times)")
+	flagSet.String("gitlab-base-url", "", "the base URL of a self-hosted GitLab the endpoints are derived from, ie: https://gitlab.example.com")
+	flagSet.Var(&gitlabGroups, "gitlab-group", "restrict logins to members of this gitlab group or subgroup (may be given multiple times)")
+	flagSet.Var(&gitlabProjects, "gitlab-project", "restrict logins to members of this gitlab project, as <path>[=<minimum access level>] (may be given multiple times)")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
+	flagSet.Duration("google-group-cache-ttl", time.Duration(5)*time.Minute, "how long google group memberships are cached before they're looked up again, 0 disables the cache")
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.String("keycloak-realm-url", "", "the keycloak realm the endpoints are derived from, ie: https://keycloak.example.com/auth/realms/myrealm")
+	flagSet.Var(&keycloakGroups, "keycloak-group", "restrict logins to members of this keycloak group (may be given multiple times)")
+	flagSet.Var(&keycloakRoles, "keycloak-role", "restrict logins to users with this keycloak realm role, or <client>:<role> client role (may be given multiple times)")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
-	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
+	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file or ldap server is provided")
+	flagSet.String("ldap-url", "", "additionally authenticate against an LDAP server: ldap://host[:port] or ldaps://host[:port]")
+	flagSet.Bool("ldap-start-tls", false, "upgrade ldap:// connections with StartTLS")
+	flagSet.String("ldap-bind-dn", "", "DN to bind as to search for users and groups (default anonymous)")
+	flagSet.String("ldap-bind-password", "", "password of the ldap-bind-dn")
+	flagSet.String("ldap-base-dn", "", "DN to search for users below")
+	flagSet.String("ldap-user-filter", "(uid=%s)", "filter finding a user's entry, %s is replaced by the username")
+	flagSet.String("ldap-email-attribute", "mail", "attribute of the user's entry holding their email")
+	flagSet.String("ldap-group-base-dn", "", "DN to search for groups below (default the DNs in the user's memberOf attribute)")
+	flagSet.String("ldap-group-filter", "(member=%s)", "filter finding a user's groups, %s is replaced by the user's DN")
+	flagSet.String("ldap-group-attribute", "cn", "attribute of group entries holding the group name")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
+	flagSet.Var(&cookieSecretsOld, "cookie-secret-old", "a previous cookie-secret, still accepted on cookies that are then re-issued with the cookie-secret (may be given multiple times)")
 	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
 
+	flagSet.String("session-store-type", "cookie", "where sessions are kept: \"cookie\" or \"redis\"")
+	flagSet.String("redis-connection-url", "", "URL of the redis server for the redis session store (ie: redis://HOST[:PORT])")
+
 	flagSet.Bool("request-logging", true, "Log requests to stdout")
 	flagSet.String("request-logging-format", defaultRequestLoggingFormat, "Template for log lines")
 
 	flagSet.String("provider", "google", "OAuth provider")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com)")
+	flagSet.String("oidc-groups-claim", "groups", "which OpenID Connect claim holds the user's groups; nested claims are separated by dots (ie: realm_access.roles)")
+	flagSet.Bool("oidc-logout", false, "sign out of the OpenID Connect provider too, via its end_session_endpoint")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("introspection-url", "", "RFC 7662 token introspection endpoint; opaque bearer tokens are accepted if it reports them active")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+	flagSet.Bool("use-pkce", false, "use PKCE (S256 code_challenge) in the authorization code flow")
+	flagSet.Bool("public-client", false, "don't send the client secret to the provider; implies -use-pkce")
+	flagSet.Var(&extraProviders, "extra-provider", "another provider offered on the sign in page, as query parameters: id=<id>&provider=<provider>&client-id=...&client-secret=... (may be given multiple times)")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
 
@@ -125,6 +181,12 @@ func main() {
 		}
 	}
 
+	if opts.ldapAuthenticator != nil {
+		log.Printf("using ldap server %s", opts.LDAPURL)
+		oauthproxy.LDAPAuthenticator = opts.ldapAuthenticator
+		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
+	}
+
 	s := &Server{
 		Handler: LoggingHandler(os.Stdout, oauthproxy, opts.RequestLogging, opts.RequestLoggingFormat),
 		Opts:    opts,
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -10,17 +12,24 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/sessions"
+	oidc "github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
 )
 
 const SignatureHeader = "GAP-Signature"
 
+// maxCookieLength is the largest Set-Cookie value browsers reliably accept.
+// Session cookies longer than this are split into numbered chunks.
+const maxCookieLength = 4096
+
 var SignatureHeaders []string = []string{
 	"Content-Length",
 	"Content-Md5",
@@ -36,6 +45,7 @@ var SignatureHeaders []string = []string{
 
 type OAuthProxy struct {
 	CookieSeed     string
+	OldCookieSeeds []string
 	CookieName     string
 	CSRFCookieName string
 	CookieDomain   string
@@ -52,22 +62,40 @@ type OAuthProxy struct {
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	UpstreamsPath     string
+	// BackChannelLogoutPath receives OIDC back-channel logout tokens
+	BackChannelLogoutPath string
+	// AuthRequestOriginalURI matches the access rules for AuthOnlyPath
+	// requests against the original request the proxy's headers describe
+	AuthRequestOriginalURI bool
 
 	redirectURL         *url.URL // the url to receive requests at
 	provider            providers.Provider
+	extraProviders      []providers.Provider
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
+	LDAPAuthenticator   *LDAPAuthenticator
 	DisplayHtpasswdForm bool
-	serveMux            http.Handler
+	serveMux            *virtualHostMux
 	SetXAuthRequest     bool
 	PassBasicAuth       bool
 	SkipProviderButton  bool
 	PassUserHeaders     bool
 	BasicAuthPassword   string
 	PassAccessToken     bool
+	UsePKCE             bool
 	CookieCipher        *cookie.Cipher
+	sessionStore        sessions.SessionStore
 	skipAuthRegex       []string
+	whitelistDomains    []string
+	allowedGroups       []string
+	accessRules         []*AccessRule
+	virtualHosts        []*VirtualHost
+	upstreamPools       []*upstreamPool
+	jwtBearerVerifiers  []*oidc.IDTokenVerifier
+	tokenIntrospector   *providers.TokenIntrospector
+	groupsClaim         string
 	skipAuthPreflight   bool
 	compiledRegex       []*regexp.Regexp
 	templates           *template.Template
@@ -78,10 +106,17 @@ type UpstreamProxy struct {
 	upstream string
 	handler  http.Handler
 	auth     hmacauth.HmacAuth
+	// config holds the options of upstreams from the --upstreams-file
+	config *UpstreamConfig
 }
 
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("GAP-Upstream-Address", u.upstream)
+	if u.config != nil {
+		for name, value := range u.config.Headers {
+			r.Header.Set(name, value)
+		}
+	}
 	if u.auth != nil {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
 		u.auth.SignRequest(r)
@@ -115,6 +150,51 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
 }
 
+// handleUpstream registers the upstream with the ServeMux of the host, ""
+// for the --upstream flags, by its path
+func handleUpstream(serveMux *http.ServeMux, host string, u *url.URL, passHostHeader bool, auth hmacauth.HmacAuth) {
+	path := u.Path
+	switch u.Scheme {
+	case "http", "https":
+		u.Path = ""
+		log.Printf("mapping path %q => upstream %q", host+path, u)
+		proxy := NewReverseProxy(u)
+		if !passHostHeader {
+			setProxyUpstreamHostHeader(proxy, u)
+		} else {
+			setProxyDirector(proxy)
+		}
+		serveMux.Handle(path,
+			&UpstreamProxy{u.Host, newWebSocketProxy(u, passHostHeader, proxy), auth, nil})
+	case "file":
+		if u.Fragment != "" {
+			path = u.Fragment
+		}
+		log.Printf("mapping path %q => file system %q", host+path, u.Path)
+		proxy := NewFileServer(path, u.Path)
+		serveMux.Handle(path, &UpstreamProxy{path, proxy, nil, nil})
+	default:
+		panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
+	}
+}
+
+// handleUpstreamConfig registers the upstream of the --upstreams-file with
+// the ServeMux of its host, and returns the pool of its http(s) urls
+func handleUpstreamConfig(serveMux *http.ServeMux, c *UpstreamConfig, passHostHeader bool, auth hmacauth.HmacAuth) *upstreamPool {
+	if c.url.Scheme == "file" {
+		log.Printf("mapping path %q => file system %q", c.Host+c.Path, c.url.Path)
+		proxy := NewFileServer(c.Path, c.url.Path)
+		serveMux.Handle(c.Path, &UpstreamProxy{c.Path, proxy, nil, c})
+		return nil
+	}
+	pool := newUpstreamPool(c, boolOption(c.PassHostHeader, passHostHeader))
+	for _, b := range pool.backends {
+		log.Printf("mapping path %q => upstream %q", c.Host+c.Path, b.url)
+	}
+	serveMux.Handle(c.Path, &UpstreamProxy{c.url.Host, pool, auth, c})
+	return pool
+}
+
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	serveMux := http.NewServeMux()
 	var auth hmacauth.HmacAuth
@@ -123,28 +203,22 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 			SignatureHeader, SignatureHeaders)
 	}
 	for _, u := range opts.proxyURLs {
-		path := u.Path
-		switch u.Scheme {
-		case "http", "https":
-			u.Path = ""
-			log.Printf("mapping path %q => upstream %q", path, u)
-			proxy := NewReverseProxy(u)
-			if !opts.PassHostHeader {
-				setProxyUpstreamHostHeader(proxy, u)
-			} else {
-				setProxyDirector(proxy)
-			}
-			serveMux.Handle(path,
-				&UpstreamProxy{u.Host, proxy, auth})
-		case "file":
-			if u.Fragment != "" {
-				path = u.Fragment
-			}
-			log.Printf("mapping path %q => file system %q", path, u.Path)
-			proxy := NewFileServer(path, u.Path)
-			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil})
-		default:
-			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
+		handleUpstream(serveMux, "", u, opts.PassHostHeader, auth)
+	}
+	for _, vh := range opts.virtualHosts {
+		vh.mux = http.NewServeMux()
+		for _, u := range vh.Upstreams {
+			handleUpstream(vh.mux, vh.Host, u, opts.PassHostHeader, auth)
+		}
+	}
+	var upstreamPools []*upstreamPool
+	for _, c := range opts.upstreamConfigs {
+		mux := serveMux
+		if c.Host != "" {
+			mux = findVirtualHost(opts.virtualHosts, c.Host).mux
+		}
+		if pool := handleUpstreamConfig(mux, c, opts.PassHostHeader, auth); pool != nil {
+			upstreamPools = append(upstreamPools, pool)
 		}
 	}
 	for _, u := range opts.CompiledRegex {
@@ -155,6 +229,9 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
 
 	log.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	for _, provider := range opts.extraProviders {
+		log.Printf("OAuthProxy configured for %s (%s) Client ID: %s", provider.Data().ProviderName, provider.Data().ProviderID, provider.Data().ClientID)
+	}
 	refresh := "disabled"
 	if opts.CookieRefresh != time.Duration(0) {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
@@ -162,19 +239,45 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 
 	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, opts.CookieDomain, refresh)
 
+	// new cookies use the first secret, the old ones are still accepted
+	secrets := append([]string{opts.CookieSecret}, opts.CookieSecretsOld...)
 	var cipher *cookie.Cipher
-	if opts.PassAccessToken || (opts.CookieRefresh != time.Duration(0)) {
+	if opts.needsCookieCipher() {
+		var oldSecrets [][]byte
+		for _, secret := range secrets[1:] {
+			oldSecrets = append(oldSecrets, secretBytes(secret))
+		}
 		var err error
-		cipher, err = cookie.NewCipher(secretBytes(opts.CookieSecret))
+		cipher, err = cookie.NewCipher(secretBytes(secrets[0]), oldSecrets...)
 		if err != nil {
 			log.Fatal("cookie-secret error: ", err)
 		}
 	}
 
+	var sessionStore sessions.SessionStore
+	switch opts.SessionStoreType {
+	case "redis":
+		var err error
+		sessionStore, err = sessions.NewRedisSessionStore(opts.RedisConnectionURL, opts.CookieName, opts.CookieExpire, opts.provider)
+		if err != nil {
+			log.Fatal("session-store error: ", err)
+		}
+		log.Printf("Session store: redis %s", opts.RedisConnectionURL)
+	default:
+		sessionStore = sessions.NewCookieSessionStore(opts.provider, cipher)
+	}
+
+	var tokenIntrospector *providers.TokenIntrospector
+	if opts.provider.Data().IntrospectURL != nil {
+		tokenIntrospector = providers.NewTokenIntrospector(opts.provider)
+		log.Printf("Introspecting bearer tokens at %s", opts.provider.Data().IntrospectURL)
+	}
+
 	return &OAuthProxy{
 		CookieName:     opts.CookieName,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
-		CookieSeed:     opts.CookieSecret,
+		CookieSeed:     secrets[0],
+		OldCookieSeeds: secrets[1:],
 		CookieDomain:   opts.CookieDomain,
 		CookieSecure:   opts.CookieSecure,
 		CookieHttpOnly: opts.CookieHttpOnly,
@@ -189,12 +292,26 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		UpstreamsPath:     fmt.Sprintf("%s/upstreams", opts.ProxyPrefix),
+
+		BackChannelLogoutPath: fmt.Sprintf("%s/backchannel_logout", opts.ProxyPrefix),
+
+		AuthRequestOriginalURI: opts.AuthRequestOriginalURI,
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
-		serveMux:           serveMux,
+		extraProviders:     opts.extraProviders,
+		serveMux:           &virtualHostMux{opts.virtualHosts, serveMux},
 		redirectURL:        redirectURL,
 		skipAuthRegex:      opts.SkipAuthRegex,
+		whitelistDomains:   opts.WhitelistDomains,
+		allowedGroups:      opts.AllowedGroups,
+		accessRules:        opts.accessRules,
+		virtualHosts:       opts.virtualHosts,
+		upstreamPools:      upstreamPools,
+		jwtBearerVerifiers: opts.jwtBearerVerifiers,
+		tokenIntrospector:  tokenIntrospector,
+		groupsClaim:        opts.OIDCGroupsClaim,
 		skipAuthPreflight:  opts.SkipAuthPreflight,
 		compiledRegex:      opts.CompiledRegex,
 		SetXAuthRequest:    opts.SetXAuthRequest,
@@ -203,7 +320,9 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		BasicAuthPassword:  opts.BasicAuthPassword,
 		PassAccessToken:    opts.PassAccessToken,
 		SkipProviderButton: opts.SkipProviderButton,
+		UsePKCE:            opts.UsePKCE || opts.PublicClient,
 		CookieCipher:       cipher,
+		sessionStore:       sessionStore,
 		templates:          loadTemplates(opts.CustomTemplatesDir),
 		Footer:             opts.Footer,
 	}
@@ -227,26 +346,57 @@ func (p *OAuthProxy) GetRedirectURI(host string) string {
 	return u.String()
 }
 
+// getProviderRedirectURI returns the callback URL of provider; each of the
+// extra providers has its own below the default one
+func (p *OAuthProxy) getProviderRedirectURI(host string, provider providers.Provider) string {
+	redirectURI := p.GetRedirectURI(host)
+	id := provider.Data().ProviderID
+	if id == "" {
+		return redirectURI
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + id
+	return u.String()
+}
+
+// getProvider returns the provider with the given ProviderID, or nil if it
+// isn't configured. The default provider has an empty ID.
+func (p *OAuthProxy) getProvider(id string) providers.Provider {
+	if id == "" {
+		return p.provider
+	}
+	for _, provider := range p.extraProviders {
+		if provider.Data().ProviderID == id {
+			return provider
+		}
+	}
+	return nil
+}
+
 func (p *OAuthProxy) displayCustomLoginForm() bool {
-	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
+	return (p.HtpasswdFile != nil || p.LDAPAuthenticator != nil) && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(provider providers.Provider, host, code, codeVerifier string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
-	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	redirectURI := p.getProviderRedirectURI(host, provider)
+	s, err = provider.Redeem(redirectURI, code, codeVerifier)
 	if err != nil {
 		return
 	}
+	s.Provider = provider.Data().ProviderID
 
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		s.Email, err = provider.GetEmailAddress(s)
 	}
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(s)
+		s.User, err = provider.GetUserName(s)
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
@@ -257,14 +407,80 @@ func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, e
 func (p *OAuthProxy) MakeSessionCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	if value != "" {
 		value = cookie.SignedValue(p.CookieSeed, p.CookieName, value, now)
-		if len(value) > 4096 {
-			// Cookies cannot be larger than 4kb
-			log.Printf("WARNING - Cookie Size: %d bytes", len(value))
-		}
 	}
 	return p.makeCookie(req, p.CookieName, value, expiration, now)
 }
 
+// sessionCookieChunkName returns the name of the i-th cookie a split
+// session cookie is stored in
+func (p *OAuthProxy) sessionCookieChunkName(i int) string {
+	return fmt.Sprintf("%s_%d", p.CookieName, i)
+}
+
+// splitSessionCookie splits c into numbered chunks when it is too large for
+// browsers to store as a single cookie
+func (p *OAuthProxy) splitSessionCookie(c *http.Cookie) []*http.Cookie {
+	if len(c.String()) <= maxCookieLength {
+		return []*http.Cookie{c}
+	}
+	var cookies []*http.Cookie
+	value := c.Value
+	for i := 0; value != ""; i++ {
+		chunk := *c
+		chunk.Name = p.sessionCookieChunkName(i)
+		chunk.Value = ""
+		size := maxCookieLength - len(chunk.String())
+		if size <= 0 {
+			// the attributes alone fill a cookie, chunks wouldn't fit either
+			log.Printf("not splitting cookie %s: its attributes exceed %d bytes", c.Name, maxCookieLength)
+			return []*http.Cookie{c}
+		}
+		if size > len(value) {
+			size = len(value)
+		}
+		chunk.Value, value = value[:size], value[size:]
+		cookies = append(cookies, &chunk)
+	}
+	return cookies
+}
+
+// sessionCookieNames returns the names of all session cookies, whole or
+// chunked, present in req
+func (p *OAuthProxy) sessionCookieNames(req *http.Request) []string {
+	var names []string
+	if _, err := req.Cookie(p.CookieName); err == nil {
+		names = append(names, p.CookieName)
+	}
+	for i := 0; ; i++ {
+		name := p.sessionCookieChunkName(i)
+		if _, err := req.Cookie(name); err != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// loadSessionCookie returns the session cookie from req, joining its chunks
+// back together if it was split
+func (p *OAuthProxy) loadSessionCookie(req *http.Request) (*http.Cookie, error) {
+	if c, err := req.Cookie(p.CookieName); err == nil {
+		return c, nil
+	}
+	var value []string
+	for i := 0; ; i++ {
+		c, err := req.Cookie(p.sessionCookieChunkName(i))
+		if err != nil {
+			break
+		}
+		value = append(value, c.Value)
+	}
+	if len(value) == 0 {
+		return nil, http.ErrNoCookie
+	}
+	return &http.Cookie{Name: p.CookieName, Value: strings.Join(value, "")}, nil
+}
+
 func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
 }
@@ -300,48 +516,94 @@ func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, va
 }
 
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
-	clr := p.MakeSessionCookie(req, "", time.Hour*-1, time.Now())
-	http.SetCookie(rw, clr)
+	if ticket, _, _, err := p.loadSessionTicket(req); err == nil {
+		if err := p.sessionStore.Clear(ticket); err != nil {
+			log.Printf("%s %s", getRemoteAddr(req), err)
+		}
+	}
 
-	// ugly hack because default domain changed
-	if p.CookieDomain == "" {
-		clr2 := *clr
-		clr2.Domain = req.Host
-		http.SetCookie(rw, &clr2)
+	names := p.sessionCookieNames(req)
+	if len(names) == 0 {
+		names = []string{p.CookieName}
+	}
+	for _, name := range names {
+		clr := p.makeCookie(req, name, "", time.Hour*-1, time.Now())
+		http.SetCookie(rw, clr)
+
+		// ugly hack because default domain changed
+		if p.CookieDomain == "" {
+			clr2 := *clr
+			clr2.Domain = req.Host
+			http.SetCookie(rw, &clr2)
+		}
 	}
 }
 
 func (p *OAuthProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()))
+	now := time.Now()
+	set := make(map[string]bool)
+	for _, c := range p.splitSessionCookie(p.MakeSessionCookie(req, val, p.CookieExpire, now)) {
+		http.SetCookie(rw, c)
+		set[c.Name] = true
+	}
+	// expire whatever is left of a previous session cookie that was split
+	// differently, so it can't be mixed up with the new one
+	for _, name := range p.sessionCookieNames(req) {
+		if !set[name] {
+			http.SetCookie(rw, p.makeCookie(req, name, "", time.Hour*-1, now))
+		}
+	}
 }
 
-func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
-	var age time.Duration
-	c, err := req.Cookie(p.CookieName)
+// loadSessionTicket returns the session store ticket held in the signed
+// session cookie along with the time the cookie was issued, and whether the
+// cookie should be re-issued because it was signed with an old cookie-secret.
+func (p *OAuthProxy) loadSessionTicket(req *http.Request) (string, time.Time, bool, error) {
+	c, err := p.loadSessionCookie(req)
 	if err != nil {
 		// always http.ErrNoCookie
-		return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
+		return "", time.Time{}, false, fmt.Errorf("Cookie %q not present", p.CookieName)
 	}
-	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
+	seeds := append([]string{p.CookieSeed}, p.OldCookieSeeds...)
+	val, timestamp, stale, ok := cookie.ValidateSeeds(c, seeds, p.CookieExpire)
 	if !ok {
-		return nil, age, errors.New("Cookie Signature not valid")
+		return "", time.Time{}, false, errors.New("Cookie Signature not valid")
 	}
+	return val, timestamp, stale, nil
+}
 
-	session, err := p.provider.SessionFromCookie(val, p.CookieCipher)
+func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
+	session, age, _, err := p.loadCookiedSession(req)
+	return session, age, err
+}
+
+func (p *OAuthProxy) loadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, bool, error) {
+	var age time.Duration
+	ticket, timestamp, stale, err := p.loadSessionTicket(req)
+	if err != nil {
+		return nil, age, false, err
+	}
+
+	session, err := p.sessionStore.Load(ticket)
 	if err != nil {
-		return nil, age, err
+		return nil, age, false, err
 	}
 
 	age = time.Now().Truncate(time.Second).Sub(timestamp)
-	return session, age, nil
+	return session, age, stale, nil
 }
 
+// SaveSession stores a new session and sets the cookie referencing it
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
-	value, err := p.provider.CookieForSession(s, p.CookieCipher)
+	return p.saveSession(rw, req, "", s)
+}
+
+func (p *OAuthProxy) saveSession(rw http.ResponseWriter, req *http.Request, ticket string, s *providers.SessionState) error {
+	ticket, err := p.sessionStore.Save(ticket, s)
 	if err != nil {
 		return err
 	}
-	p.SetSessionCookie(rw, req, value)
+	p.SetSessionCookie(rw, req, ticket)
 	return nil
 }
 
@@ -382,8 +644,19 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		redirect_url = "/"
 	}
 
+	// one button per provider, the default one first
+	type signInProvider struct {
+		ID   string
+		Name string
+	}
+	signInProviders := []signInProvider{{"", p.provider.Data().ProviderName}}
+	for _, provider := range p.extraProviders {
+		signInProviders = append(signInProviders, signInProvider{provider.Data().ProviderID, provider.Data().ProviderName})
+	}
+
 	t := struct {
 		ProviderName  string
+		Providers     []signInProvider
 		SignInMessage string
 		CustomLogin   bool
 		Redirect      string
@@ -392,6 +665,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		Footer        template.HTML
 	}{
 		ProviderName:  p.provider.Data().ProviderName,
+		Providers:     signInProviders,
 		SignInMessage: p.SignInMessage,
 		CustomLogin:   p.displayCustomLoginForm(),
 		Redirect:      redirect_url,
@@ -402,21 +676,47 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
 
-func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool) {
-	if req.Method != "POST" || p.HtpasswdFile == nil {
-		return "", false
+func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (*providers.SessionState, bool) {
+	if req.Method != "POST" || (p.HtpasswdFile == nil && p.LDAPAuthenticator == nil) {
+		return nil, false
 	}
 	user := req.FormValue("username")
 	passwd := req.FormValue("password")
 	if user == "" {
-		return "", false
+		return nil, false
 	}
 	// check auth
-	if p.HtpasswdFile.Validate(user, passwd) {
+	session, err := p.checkPassword(user, passwd)
+	if err != nil {
+		log.Printf("%s %s", getRemoteAddr(req), err)
+		return nil, false
+	}
+	return session, true
+}
+
+// checkPassword authenticates the user against the HtpasswdFile and then
+// the LDAPAuthenticator. Users from LDAP need an allowed email, if they have
+// one, and to be in an allowed group.
+func (p *OAuthProxy) checkPassword(user, passwd string) (*providers.SessionState, error) {
+	if p.HtpasswdFile != nil && p.HtpasswdFile.Validate(user, passwd) {
 		log.Printf("authenticated %q via HtpasswdFile", user)
-		return user, true
+		return &providers.SessionState{User: user}, nil
+	}
+	if p.LDAPAuthenticator == nil {
+		return nil, fmt.Errorf("%s not in HtpasswdFile", user)
+	}
+	session, err := p.LDAPAuthenticator.Authenticate(user, passwd)
+	if err != nil {
+		return nil, err
+	}
+	if session.Email != "" && !p.Validator(session.Email) {
+		return nil, fmt.Errorf("Permission Denied: %q is unauthorized", session.Email)
 	}
-	return "", false
+	if !p.isInAllowedGroup(session) {
+		return nil, fmt.Errorf("Permission Denied: %s is not in an allowed group", session)
+	}
+	log.Printf("authenticated %q via LDAP", user)
+	return session, nil
 }
 
 func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error) {
@@ -426,13 +726,98 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 	}
 
 	redirect = req.Form.Get("rd")
-	if redirect == "" || !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
 
 	return
 }
 
+// IsValidRedirect checks whether redirect is a path on this host or an
+// absolute URL on one of the whitelisted domains
+func (p *OAuthProxy) IsValidRedirect(redirect string) bool {
+	switch {
+	case strings.HasPrefix(redirect, "/"):
+		// browsers treat "/\" like "//", a protocol relative URL
+		return !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\")
+	case strings.HasPrefix(redirect, "http://") || strings.HasPrefix(redirect, "https://"):
+		u, err := url.Parse(redirect)
+		if err != nil {
+			return false
+		}
+		host := u.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		for _, domain := range p.whitelistDomains {
+			if host == strings.TrimPrefix(domain, ".") ||
+				(strings.HasPrefix(domain, ".") && strings.HasSuffix(host, domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upstreamConfig returns the --upstreams-file options of the upstream
+// serving the request, nil for the other upstreams
+func (p *OAuthProxy) upstreamConfig(req *http.Request) *UpstreamConfig {
+	if p.serveMux == nil {
+		return nil
+	}
+	if u := p.serveMux.upstream(req); u != nil {
+		return u.config
+	}
+	return nil
+}
+
+// isAllowedByRules checks the session against the requirements of the
+// request's virtual host and upstream, and the first access rule that
+// matches the request. Requests no rule matches are allowed.
+func (p *OAuthProxy) isAllowedByRules(req *http.Request, s *providers.SessionState) bool {
+	if vh := matchVirtualHost(p.virtualHosts, req); vh != nil && !vh.Rule.Allows(s) {
+		return false
+	}
+	if c := p.upstreamConfig(req); c != nil && !c.rule.Allows(s) {
+		return false
+	}
+	for _, rule := range p.accessRules {
+		if rule.Matches(req) {
+			return rule.Allows(s)
+		}
+	}
+	return true
+}
+
+// isInAllowedGroup checks whether the session's user is a member of any of
+// the allowed groups, if there are any
+func (p *OAuthProxy) isInAllowedGroup(s *providers.SessionState) bool {
+	if len(p.allowedGroups) == 0 {
+		return true
+	}
+	for _, group := range s.Groups {
+		for _, allowed := range p.allowedGroups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// absoluteURL returns redirect as an absolute URL, using the request host
+// for paths
+func (p *OAuthProxy) absoluteURL(req *http.Request, redirect string) string {
+	if !strings.HasPrefix(redirect, "/") {
+		return redirect
+	}
+	scheme := "https"
+	if !p.CookieSecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, req.Host, redirect)
+}
+
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
 	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
@@ -470,10 +855,14 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.SignOut(rw, req)
 	case path == p.OAuthStartPath:
 		p.OAuthStart(rw, req)
-	case path == p.OAuthCallbackPath:
+	case path == p.OAuthCallbackPath || strings.HasPrefix(path, p.OAuthCallbackPath+"/"):
 		p.OAuthCallback(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.UpstreamsPath:
+		p.UpstreamsStatus(rw, req)
+	case path == p.BackChannelLogoutPath:
+		p.BackChannelLogout(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
@@ -486,13 +875,12 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user, ok := p.ManualSignIn(rw, req)
+	session, ok := p.ManualSignIn(rw, req)
 	if ok {
-		session := &providers.SessionState{User: user}
 		p.SaveSession(rw, req, session)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
-		if p.SkipProviderButton {
+		if p.SkipProviderButton && len(p.extraProviders) == 0 {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusOK)
@@ -501,8 +889,57 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+	// the id_token is needed as a hint to log out of the provider
+	session, _, _ := p.LoadCookiedSession(req)
 	p.ClearSessionCookie(rw, req)
-	http.Redirect(rw, req, "/", 302)
+	provider := p.provider
+	if session != nil && p.getProvider(session.Provider) != nil {
+		provider = p.getProvider(session.Provider)
+	}
+	if logoutURL := provider.GetLogoutURL(session, p.absoluteURL(req, redirect)); logoutURL != "" {
+		redirect = logoutURL
+	}
+	http.Redirect(rw, req, redirect, 302)
+}
+
+// BackChannelLogout revokes the sessions named by the logout_token an OIDC
+// provider posts when a user logs out or is disabled there
+func (p *OAuthProxy) BackChannelLogout(rw http.ResponseWriter, req *http.Request) {
+	remoteAddr := getRemoteAddr(req)
+	rw.Header().Set("Cache-Control", "no-store")
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logoutToken := req.PostFormValue("logout_token")
+	sid, sub, err := p.provider.VerifyLogoutToken(logoutToken)
+	for _, provider := range p.extraProviders {
+		if err == nil {
+			break
+		}
+		sid, sub, err = provider.VerifyLogoutToken(logoutToken)
+	}
+	if err != nil {
+		log.Printf("%s back-channel logout: %s", remoteAddr, err)
+		http.Error(rw, "invalid logout_token", http.StatusBadRequest)
+		return
+	}
+	err = p.sessionStore.Revoke(sid, sub)
+	if err == sessions.ErrRevokeNotSupported {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		log.Printf("%s back-channel logout: %s", remoteAddr, err)
+		http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s back-channel logout: revoked sessions of sid:%q sub:%q", remoteAddr, sid, sub)
+	rw.WriteHeader(http.StatusOK)
 }
 
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
@@ -511,14 +948,31 @@ func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
+	// the PKCE code_verifier is kept next to the nonce in the CSRF cookie
+	csrf := nonce
+	var codeChallenge string
+	if p.UsePKCE {
+		codeVerifier, err := cookie.CodeVerifier()
+		if err != nil {
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		csrf = fmt.Sprintf("%v:%v", nonce, codeVerifier)
+		codeChallenge = cookie.CodeChallenge(codeVerifier)
+	}
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	provider := p.getProvider(req.Form.Get("provider"))
+	if provider == nil {
+		p.ErrorPage(rw, 400, "Bad Request", "Unknown Provider")
+		return
+	}
+	p.SetCSRFCookie(rw, req, csrf)
+	redirectURI := p.getProviderRedirectURI(req.Host, provider)
+	http.Redirect(rw, req, provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect), codeChallenge), 302)
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
@@ -535,8 +989,19 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		p.ErrorPage(rw, 403, "Permission Denied", errorString)
 		return
 	}
+	provider := p.getProvider(strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, p.OAuthCallbackPath), "/"))
+	if provider == nil {
+		p.ErrorPage(rw, 404, "Not Found", "Unknown Provider")
+		return
+	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	var codeVerifier string
+	if c, err := req.Cookie(p.CSRFCookieName); err == nil {
+		if csrf := strings.SplitN(c.Value, ":", 2); len(csrf) == 2 {
+			codeVerifier = csrf[1]
+		}
+	}
+	session, err := p.redeemCode(provider, req.Host, req.Form.Get("code"), codeVerifier)
 	if err != nil {
 		log.Printf("%s error redeeming code %s", remoteAddr, err)
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
@@ -556,18 +1021,18 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
+	if strings.SplitN(c.Value, ":", 2)[0] != nonce {
 		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
 		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
 		return
 	}
 
-	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
 
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+	if p.Validator(session.Email) && provider.ValidateGroup(session.Email) && p.isInAllowedGroup(session) {
 		log.Printf("%s authentication complete %s", remoteAddr, session)
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
@@ -583,21 +1048,57 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
-	if status == http.StatusAccepted {
+	target, err := p.authRequestTarget(req)
+	if err != nil {
+		log.Printf("%s %s", getRemoteAddr(req), err)
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	session, err := p.authenticate(rw, req, target)
+	if session != nil {
 		rw.WriteHeader(http.StatusAccepted)
+	} else if err == errAccessDenied {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
 	} else {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 	}
 }
 
+// UpstreamsStatus returns the status of the backends of the upstream pools
+// as JSON, to signed in users, listing only the pools whose host and path
+// the access rules let the user reach
+func (p *OAuthProxy) UpstreamsStatus(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.authenticate(rw, req, req)
+	if err == errAccessDenied {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	} else if session == nil {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	pools := []upstreamPoolStatus{}
+	for _, pool := range p.upstreamPools {
+		if p.isAllowedByRules(pool.request(), session) {
+			pools = append(pools, pool.status())
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(pools)
+}
+
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
-	if status == http.StatusInternalServerError {
+	if c := p.upstreamConfig(req); c != nil && c.SkipAuth {
+		p.serveMux.ServeHTTP(rw, req)
+		return
+	}
+	session, err := p.authenticate(rw, req, req)
+	if err == errAccessDenied {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Unauthorized")
+	} else if err != nil {
 		p.ErrorPage(rw, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
-	} else if status == http.StatusForbidden {
-		if p.SkipProviderButton {
+	} else if session == nil {
+		if p.SkipProviderButton && len(p.extraProviders) == 0 {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusForbidden)
@@ -608,19 +1109,97 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	session, err := p.authenticate(rw, req, req)
+	switch {
+	case session != nil:
+		return http.StatusAccepted
+	case err == nil || err == errAccessDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// authRequestTarget returns the request the access rules are checked against
+// for an /oauth2/auth request. With --auth-request-original-uri it is the
+// request the proxy's X-Original-URI or X-Forwarded-Uri, and
+// X-Original-Method or X-Forwarded-Method, headers describe.
+func (p *OAuthProxy) authRequestTarget(req *http.Request) (*http.Request, error) {
+	if !p.AuthRequestOriginalURI {
+		return req, nil
+	}
+	uri := req.Header.Get("X-Original-URI")
+	if uri == "" {
+		uri = req.Header.Get("X-Forwarded-Uri")
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid original request uri %q: %s", uri, err)
+	}
+	// nginx passes $request_uri as the client sent it, the rules have to see
+	// the path the upstream serves
+	u.Path = cleanPath(u.Path)
+	u.RawPath = ""
+	target := new(http.Request)
+	*target = *req
+	target.URL = u
+	target.RequestURI = uri
+	if method := req.Header.Get("X-Original-Method"); method != "" {
+		target.Method = method
+	} else if method := req.Header.Get("X-Forwarded-Method"); method != "" {
+		target.Method = method
+	}
+	return target, nil
+}
+
+// cleanPath returns the canonical form of the path, without "." and ".."
+// elements or repeated slashes, keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if p[len(p)-1] == '/' && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// authenticate returns the request's session, passes the user to the
+// upstream, and matches the access rules against the target request. It
+// returns no session, and no error, for requests without a valid one, and
+// errAccessDenied for signed in users the rules refuse.
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req, target *http.Request) (*providers.SessionState, error) {
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := getRemoteAddr(req)
 
-	session, sessionAge, err := p.LoadCookiedSession(req)
+	session, sessionAge, reissue, err := p.loadCookiedSession(req)
 	if err != nil {
 		log.Printf("%s %s", remoteAddr, err)
 	}
+	if session != nil && reissue {
+		log.Printf("%s re-issuing session cookie signed with a previous cookie-secret for %s", remoteAddr, session)
+	}
 	if session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
+	// refresh and validate with the provider that issued the session
+	provider := p.provider
+	if session != nil {
+		if provider = p.getProvider(session.Provider); provider == nil {
+			log.Printf("%s removing session. unknown provider %s", remoteAddr, session)
+			provider = p.provider
+			session = nil
+			clearSession = true
+		}
+	}
+
+	if ok, err := provider.RefreshSessionIfNeeded(session); err != nil {
 		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
 		clearSession = true
 		session = nil
@@ -637,7 +1216,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		if !provider.ValidateSessionState(session) {
 			log.Printf("%s removing session. error validating %s", remoteAddr, session)
 			saveSession = false
 			session = nil
@@ -652,11 +1231,20 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		clearSession = true
 	}
 
-	if saveSession && session != nil {
-		err := p.SaveSession(rw, req, session)
+	if session != nil && session.Email != "" && !p.isInAllowedGroup(session) {
+		log.Printf("%s Permission Denied: %s is not in an allowed group, removing session", remoteAddr, session)
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if (saveSession || reissue) && session != nil {
+		// keep updating the session the cookie already points to
+		ticket, _, _, _ := p.loadSessionTicket(req)
+		err := p.saveSession(rw, req, ticket, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			return nil, err
 		}
 	}
 
@@ -664,6 +1252,17 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		p.ClearSessionCookie(rw, req)
 	}
 
+	if session == nil && (len(p.jwtBearerVerifiers) > 0 || p.tokenIntrospector != nil) {
+		session, err = p.GetBearerSession(req)
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+		if session != nil && !(p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) && p.isInAllowedGroup(session)) {
+			log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
+			session = nil
+		}
+	}
+
 	if session == nil {
 		session, err = p.CheckBasicAuth(req)
 		if err != nil {
@@ -672,18 +1271,29 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		return nil, nil
+	}
+
+	if !p.isAllowedByRules(target, session) {
+		log.Printf("%s Permission Denied: %s is not allowed to %s %s%s", remoteAddr, session, target.Method, target.Host, target.URL.Path)
+		return nil, errAccessDenied
 	}
 
 	// At this point, the user is authenticated. proxy normally
-	if p.PassBasicAuth {
+	passBasicAuth, passUserHeaders, passAccessToken := p.PassBasicAuth, p.PassUserHeaders, p.PassAccessToken
+	if c := p.upstreamConfig(req); c != nil {
+		passBasicAuth = boolOption(c.PassBasicAuth, passBasicAuth)
+		passUserHeaders = boolOption(c.PassUserHeaders, passUserHeaders)
+		passAccessToken = boolOption(c.PassAccessToken, passAccessToken)
+	}
+	if passBasicAuth {
 		req.SetBasicAuth(session.User, p.BasicAuthPassword)
 		req.Header["X-Forwarded-User"] = []string{session.User}
 		if session.Email != "" {
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
 	}
-	if p.PassUserHeaders {
+	if passUserHeaders {
 		req.Header["X-Forwarded-User"] = []string{session.User}
 		if session.Email != "" {
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
@@ -695,7 +1305,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
 	}
-	if p.PassAccessToken && session.AccessToken != "" {
+	if passAccessToken && session.AccessToken != "" {
 		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
 	}
 	if session.Email == "" {
@@ -703,11 +1313,61 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	return session, nil
+}
+
+// GetBearerSession returns a session for the request's "Authorization: Bearer"
+// token. JWTs are verified against the trusted issuers, other tokens are
+// looked up at the provider's introspection endpoint. The session isn't
+// saved, the token is checked again on every request.
+func (p *OAuthProxy) GetBearerSession(req *http.Request) (*providers.SessionState, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return nil, nil
+	}
+	s := strings.SplitN(auth, " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") {
+		return nil, nil
+	}
+	rawBearerToken := strings.TrimSpace(s[1])
+
+	var err error
+	if len(p.jwtBearerVerifiers) > 0 {
+		var session *providers.SessionState
+		session, err = p.GetJwtSession(rawBearerToken)
+		if err == nil {
+			return session, nil
+		}
+	}
+	if p.tokenIntrospector != nil {
+		return p.tokenIntrospector.Introspect(rawBearerToken)
+	}
+	return nil, err
+}
+
+// GetJwtSession returns a session for a JWT verified by one of the trusted
+// issuers
+func (p *OAuthProxy) GetJwtSession(rawBearerToken string) (*providers.SessionState, error) {
+	ctx := context.Background()
+	for _, verifier := range p.jwtBearerVerifiers {
+		idToken, err := verifier.Verify(ctx, rawBearerToken)
+		if err != nil {
+			continue
+		}
+		session, err := providers.SessionFromIDToken(idToken, p.groupsClaim)
+		if err != nil {
+			return nil, err
+		}
+		session.AccessToken = rawBearerToken
+		session.IDToken = rawBearerToken
+		session.User = strings.Split(session.Email, "@")[0]
+		return session, nil
+	}
+	return nil, errors.New("unable to verify jwt bearer token")
 }
 
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState, error) {
-	if p.HtpasswdFile == nil {
+	if p.HtpasswdFile == nil && p.LDAPAuthenticator == nil {
 		return nil, nil
 	}
 	auth := req.Header.Get("Authorization")
@@ -726,9 +1386,10 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState,
 	if len(pair) != 2 {
 		return nil, fmt.Errorf("invalid format %s", b)
 	}
-	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
-		log.Printf("authenticated %q via basic auth", pair[0])
-		return &providers.SessionState{User: pair[0]}, nil
+	session, err := p.checkPassword(pair[0], pair[1])
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
+	log.Printf("authenticated %q via basic auth", pair[0])
+	return session, nil
 }
@@ -2,7 +2,12 @@ package main
 
 import (
 	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -15,9 +20,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis"
+	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bitly/oauth2_proxy/sessions"
 	"github.com/mbland/hmacauth"
 	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
 )
 
 func init() {
@@ -215,6 +224,7 @@ type PassAccessTokenTest struct {
 	provider_server *httptest.Server
 	proxy           *OAuthProxy
 	opts            *Options
+	tokenRequest    url.Values
 }
 
 type PassAccessTokenTestOptions struct {
@@ -231,6 +241,8 @@ func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) *PassAccessTokenTes
 			payload := ""
 			switch url.Path {
 			case "/oauth/token":
+				r.ParseForm()
+				t.tokenRequest = r.PostForm
 				payload = `{"access_token": "my_auth_token"}`
 			default:
 				payload = r.Header.Get("X-Forwarded-Access-Token")
@@ -314,6 +326,73 @@ func (pat_test *PassAccessTokenTest) getRootEndpoint(cookie string) (http_code i
 	return rw.Code, rw.Body.String()
 }
 
+func TestOAuthStartWithPKCE(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	pat_test.proxy.UsePKCE = true
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2Ffoo", nil)
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	csrf := rw.Result().Cookies()[0]
+	assert.Equal(t, pat_test.proxy.CSRFCookieName, csrf.Name)
+	parts := strings.SplitN(csrf.Value, ":", 2)
+	assert.Equal(t, 2, len(parts))
+
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, parts[0]+":/foo", loginURL.Query().Get("state"))
+	assert.Equal(t, cookie.CodeChallenge(parts[1]), loginURL.Query().Get("code_challenge"))
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+}
+
+func TestOAuthCallbackWithPKCE(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:", nil)
+	req.AddCookie(pat_test.proxy.MakeCSRFCookie(req, "nonce:verifier", time.Hour, time.Now()))
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "verifier", pat_test.tokenRequest.Get("code_verifier"))
+}
+
+func TestOAuthCallbackDeniesUserWithoutAllowedGroup(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	pat_test.proxy.allowedGroups = []string{"admins"}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:", nil)
+	req.AddCookie(pat_test.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	for _, c := range rw.Result().Cookies() {
+		assert.NotEqual(t, pat_test.proxy.CookieName, c.Name)
+	}
+}
+
+func TestAuthenticateAllowedGroups(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.allowedGroups = []string{"admins", "ops"}
+
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"users", "ops"}}
+	pc_test.SaveSession(startSession, time.Now())
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	pc_test = NewProcessCookieTestWithDefaults()
+	pc_test.proxy.allowedGroups = []string{"admins", "ops"}
+	startSession.Groups = []string{"users"}
+	pc_test.SaveSession(startSession, time.Now())
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	// the session is removed
+	assert.Equal(t, "", pc_test.rw.Result().Cookies()[0].Value)
+}
+
 func TestForwardAccessTokenUpstream(t *testing.T) {
 	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{
 		PassAccessToken: true,
@@ -359,6 +438,92 @@ func TestDoNotForwardAccessTokenUpstream(t *testing.T) {
 	assert.Equal(t, "No access token found.", payload)
 }
 
+func TestIsValidRedirect(t *testing.T) {
+	proxy := &OAuthProxy{whitelistDomains: []string{"foo.bar", ".example.com"}}
+	for redirect, valid := range map[string]bool{
+		"":                              false,
+		"/":                             true,
+		"/some/path?query":              true,
+		"//evil.com":                    false,
+		"/\\evil.com":                   false,
+		"http://foo.bar/path":           true,
+		"https://foo.bar:8443/path":     true,
+		"https://sub.foo.bar/path":      false,
+		"https://example.com/path":      true,
+		"https://app.example.com/path":  true,
+		"https://evilexample.com/path":  false,
+		"https://example.com.evil.com/": false,
+		"javascript:alert(1)":           false,
+		"ftp://foo.bar/":                false,
+	} {
+		assert.Equal(t, valid, proxy.IsValidRedirect(redirect), redirect)
+	}
+}
+
+type SignOutTest struct {
+	proxy   *OAuthProxy
+	cookies []*http.Cookie
+}
+
+func NewSignOutTest(provider providers.Provider) *SignOutTest {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	// the session cookie keeps the id_token without other options
+	opts.OIDCLogout = true
+	opts.EmailDomains = []string{"*"}
+	opts.WhitelistDomains = []string{"example.com"}
+	opts.Validate()
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	proxy.SaveSession(rw, req, &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", IDToken: "my_id_token"})
+	return &SignOutTest{proxy: proxy, cookies: rw.Result().Cookies()}
+}
+
+func (so_test *SignOutTest) SignOut(rd string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/oauth2/sign_out?rd="+url.QueryEscape(rd), nil)
+	req.Host = "proxy.example.com"
+	for _, c := range so_test.cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	so_test.proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestSignOutRedirect(t *testing.T) {
+	so_test := NewSignOutTest(&providers.ProviderData{})
+	for rd, expected := range map[string]string{
+		"":                        "/",
+		"/foo":                    "/foo",
+		"https://example.com/bye": "https://example.com/bye",
+		"https://evil.com/gotcha": "/",
+	} {
+		rw := so_test.SignOut(rd)
+		assert.Equal(t, 302, rw.Code)
+		assert.Equal(t, expected, rw.HeaderMap.Get("Location"))
+		assert.Equal(t, "", rw.Result().Cookies()[0].Value)
+	}
+}
+
+func TestSignOutRedirectsToProviderLogout(t *testing.T) {
+	provider := providers.NewOIDCProvider(&providers.ProviderData{})
+	provider.EndSessionURL, _ = url.Parse("https://idp.example.com/logout")
+	so_test := NewSignOutTest(provider)
+
+	rw := so_test.SignOut("/foo")
+	assert.Equal(t, 302, rw.Code)
+	logoutURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "idp.example.com", logoutURL.Host)
+	assert.Equal(t, "my_id_token", logoutURL.Query().Get("id_token_hint"))
+	assert.Equal(t, "https://proxy.example.com/foo", logoutURL.Query().Get("post_logout_redirect_uri"))
+}
+
 type SignInPageTest struct {
 	opts                    *Options
 	proxy                   *OAuthProxy
@@ -836,3 +1001,644 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func TestRedisSessionStoreKeepsOnlyTicketInCookie(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start miniredis: %s", err)
+	}
+	defer mr.Close()
+
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.SessionStoreType = "redis"
+	opts.RedisConnectionURL = "redis://" + mr.Addr()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, startSession))
+	assert.Equal(t, 1, len(mr.Keys()))
+
+	c := rw.Result().Cookies()[0]
+	assert.Equal(t, false, strings.Contains(c.Value, "michael.bland"))
+	req.AddCookie(c)
+
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+
+	proxy.ClearSessionCookie(httptest.NewRecorder(), req)
+	assert.Equal(t, 0, len(mr.Keys()))
+}
+
+func TestAuthenticateReissuesCookieSignedWithOldSecret(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.PassAccessToken = true
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	old := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	assert.Equal(t, nil, old.SaveSession(rw, req, startSession))
+	req.AddCookie(rw.Result().Cookies()[0])
+
+	opts.CookieSecret = "abcdefabcd0123456789"
+	opts.CookieSecretsOld = []string{"0123456789abcdefabcd"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+
+	// the new cookie no longer depends on the old secret
+	proxy.OldCookieSeeds = nil
+	proxy.CookieCipher, _ = cookie.NewCipher(secretBytes("abcdefabcd0123456789"))
+	proxy.sessionStore = sessions.NewCookieSessionStore(proxy.provider, proxy.CookieCipher)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+}
+
+type LogoutTokenTestProvider struct {
+	*providers.ProviderData
+}
+
+func (p *LogoutTokenTestProvider) VerifyLogoutToken(rawToken string) (string, string, error) {
+	if rawToken != "valid" {
+		return "", "", errors.New("invalid logout_token")
+	}
+	return "", "123456789", nil
+}
+
+func TestBackChannelLogout(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start miniredis: %s", err)
+	}
+	defer mr.Close()
+
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.SessionStoreType = "redis"
+	opts.RedisConnectionURL = "redis://" + mr.Addr()
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = &LogoutTokenTestProvider{&providers.ProviderData{}}
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.SaveSession(rw, req, &providers.SessionState{
+		Email:   "michael.bland@gsa.gov",
+		IDToken: "my_id_token",
+		Claims:  map[string]interface{}{"sub": "123456789"},
+	})
+	req.AddCookie(rw.Result().Cookies()[0])
+	_, _, err = proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+
+	logout := func(method, token string) int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/oauth2/backchannel_logout",
+			strings.NewReader(url.Values{"logout_token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, "no-store", rw.HeaderMap.Get("Cache-Control"))
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, logout("GET", "valid"))
+	assert.Equal(t, http.StatusBadRequest, logout("POST", "forged"))
+	_, _, err = proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, http.StatusOK, logout("POST", "valid"))
+	_, _, err = proxy.LoadCookiedSession(req)
+	assert.NotEqual(t, nil, err)
+
+	// sessions kept in cookies can't be revoked
+	proxy.sessionStore = sessions.NewCookieSessionStore(proxy.provider, nil)
+	assert.Equal(t, http.StatusNotImplemented, logout("POST", "valid"))
+}
+
+func TestSessionCookieSplitIntoChunks(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: strings.Repeat("a", 6000)}
+
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, startSession))
+
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 3, len(cookies))
+	for i, c := range cookies {
+		assert.Equal(t, fmt.Sprintf("_oauth2_proxy_%d", i), c.Name)
+		assert.True(t, len(c.String()) <= maxCookieLength)
+		pc_test.req.AddCookie(c)
+	}
+
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+}
+
+func TestSplitSessionCookieWithOversizedAttributes(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	chunk := &http.Cookie{Name: pc_test.proxy.sessionCookieChunkName(0), Path: "/"}
+	for _, extra := range []int{0, 100} {
+		c := &http.Cookie{Name: pc_test.proxy.CookieName, Value: strings.Repeat("a", 100)}
+		c.Path = "/" + strings.Repeat("p", maxCookieLength-len(chunk.String())+extra)
+		assert.Equal(t, []*http.Cookie{c}, pc_test.proxy.splitSessionCookie(c))
+	}
+}
+
+func TestSetSessionCookieExpiresStaleChunks(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_0", Value: "stale"})
+	pc_test.req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_1", Value: "stale"})
+
+	rw := httptest.NewRecorder()
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov"}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, startSession))
+
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 3, len(cookies))
+	assert.Equal(t, "_oauth2_proxy", cookies[0].Name)
+	assert.NotEqual(t, "", cookies[0].Value)
+	for i, c := range cookies[1:] {
+		assert.Equal(t, fmt.Sprintf("_oauth2_proxy_%d", i), c.Name)
+		assert.Equal(t, "", c.Value)
+		assert.True(t, c.Expires.Before(time.Now()))
+	}
+}
+
+func TestClearSessionCookieClearsChunks(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieDomain = "example.com"
+	pc_test.req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_0", Value: "a"})
+	pc_test.req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_1", Value: "b"})
+
+	rw := httptest.NewRecorder()
+	pc_test.proxy.ClearSessionCookie(rw, pc_test.req)
+
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 2, len(cookies))
+	for i, c := range cookies {
+		assert.Equal(t, fmt.Sprintf("_oauth2_proxy_%d", i), c.Name)
+		assert.Equal(t, "", c.Value)
+		assert.True(t, c.Expires.Before(time.Now()))
+	}
+}
+
+type JwtIssuerTest struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func NewJwtIssuerTest(t *testing.T) *JwtIssuerTest {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	issuer := &JwtIssuerTest{key: key}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 issuer.URL,
+				"authorization_endpoint": issuer.URL + "/authorize",
+				"token_endpoint":         issuer.URL + "/token",
+				"jwks_uri":               issuer.URL + "/keys",
+			})
+		case "/keys":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+			}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return issuer
+}
+
+func (j *JwtIssuerTest) Token(audience string, claims map[string]interface{}) string {
+	all := map[string]interface{}{
+		"iss":            j.URL,
+		"aud":            audience,
+		"sub":            "123456789",
+		"email":          "michael.bland@gsa.gov",
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: j.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		panic(err)
+	}
+	payload, _ := json.Marshal(all)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		panic(err)
+	}
+	token, _ := jws.CompactSerialize()
+	return token
+}
+
+func NewJwtBearerTest(t *testing.T, issuer *JwtIssuerTest) *ProcessCookieTest {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.opts.SkipJwtBearerTokens = true
+	pc_test.opts.ExtraJwtIssuers = []string{issuer.URL + "=api"}
+	if msgs := parseJwtIssuers(pc_test.opts, []string{}); len(msgs) != 0 {
+		t.Fatal(msgs)
+	}
+	pc_test.proxy.jwtBearerVerifiers = pc_test.opts.jwtBearerVerifiers
+	return pc_test
+}
+
+func TestAuthenticateWithJwtBearerToken(t *testing.T) {
+	issuer := NewJwtIssuerTest(t)
+	defer issuer.Close()
+
+	pc_test := NewJwtBearerTest(t, issuer)
+	pc_test.req.Header.Set("Authorization", "Bearer "+issuer.Token("api", nil))
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, "michael.bland", pc_test.req.Header.Get("X-Forwarded-User"))
+	assert.Equal(t, "michael.bland@gsa.gov", pc_test.req.Header.Get("X-Forwarded-Email"))
+	// the session is only good for this request
+	assert.Equal(t, 0, len(pc_test.rw.Result().Cookies()))
+}
+
+func TestAuthenticateRejectsInvalidJwtBearerToken(t *testing.T) {
+	issuer := NewJwtIssuerTest(t)
+	defer issuer.Close()
+
+	for _, token := range []string{
+		issuer.Token("other-api", nil),
+		issuer.Token("api", map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}),
+		"not-a-jwt",
+	} {
+		pc_test := NewJwtBearerTest(t, issuer)
+		pc_test.req.Header.Set("Authorization", "Bearer "+token)
+		assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	}
+}
+
+func TestAuthenticateJwtBearerTokenChecksUserAndGroups(t *testing.T) {
+	issuer := NewJwtIssuerTest(t)
+	defer issuer.Close()
+
+	pc_test := NewJwtBearerTest(t, issuer)
+	pc_test.validate_user = false
+	pc_test.req.Header.Set("Authorization", "Bearer "+issuer.Token("api", nil))
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	pc_test = NewJwtBearerTest(t, issuer)
+	pc_test.proxy.allowedGroups = []string{"admins"}
+	pc_test.req.Header.Set("Authorization", "Bearer "+issuer.Token("api",
+		map[string]interface{}{"groups": []string{"users"}}))
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	pc_test = NewJwtBearerTest(t, issuer)
+	pc_test.proxy.allowedGroups = []string{"admins"}
+	pc_test.req.Header.Set("Authorization", "Bearer "+issuer.Token("api",
+		map[string]interface{}{"groups": []string{"users", "admins"}}))
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestAuthenticateWithIntrospectedBearerToken(t *testing.T) {
+	introspection := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		active := r.PostForm.Get("token") == "opaque_token"
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"active":    active,
+			"email":     "michael.bland@gsa.gov",
+			"exp":       time.Now().Add(time.Hour).Unix(),
+			"client_id": "bazquux",
+		})
+	}))
+	defer introspection.Close()
+
+	for token, expected := range map[string]int{
+		"opaque_token":  http.StatusAccepted,
+		"revoked_token": http.StatusForbidden,
+	} {
+		introspection_url, _ := url.Parse(introspection.URL)
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.provider = &TestProvider{
+			ProviderData: &providers.ProviderData{
+				ClientID: "bazquux", IntrospectURL: introspection_url},
+			ValidToken: true,
+		}
+		pc_test.proxy.tokenIntrospector = providers.NewTokenIntrospector(pc_test.proxy.provider)
+		pc_test.req.Header.Set("Authorization", "Bearer "+token)
+		assert.Equal(t, expected, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	}
+}
+
+func NewExtraTestProvider(provider_url *url.URL, id, email_address string) *TestProvider {
+	provider := NewTestProvider(provider_url, email_address)
+	provider.ProviderID = id
+	provider.ProviderName = "Contractors"
+	provider.ValidToken = true
+	return provider
+}
+
+func TestSignInPageListsExtraProviders(t *testing.T) {
+	sip_test := NewSignInPageTest(true)
+	provider_url, _ := url.Parse("http://contractors.example.com")
+	sip_test.proxy.extraProviders = []providers.Provider{
+		NewExtraTestProvider(provider_url, "contractors", "contractor@example.com"),
+	}
+
+	// the chooser isn't skipped with more than one provider
+	code, body := sip_test.GetEndpoint("/some/random/endpoint")
+	assert.Equal(t, 403, code)
+	assert.Contains(t, body, "Sign in with Google")
+	assert.Contains(t, body, "Sign in with Contractors")
+	assert.Contains(t, body, `<input type="hidden" name="provider" value="contractors">`)
+	assert.Equal(t, 2, len(sip_test.sign_in_regexp.FindAllString(body, -1)))
+}
+
+func TestOAuthStartWithExtraProvider(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{})
+	defer pat_test.Close()
+	provider_url, _ := url.Parse("http://contractors.example.com")
+	pat_test.proxy.extraProviders = []providers.Provider{
+		NewExtraTestProvider(provider_url, "contractors", "contractor@example.com"),
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?provider=contractors&rd=/foo", nil)
+	req.Host = "proxy.example.com"
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "contractors.example.com", loginURL.Host)
+	assert.Equal(t, "http://proxy.example.com/oauth2/callback/contractors",
+		loginURL.Query().Get("redirect_uri"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=unknown", nil)
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+}
+
+func TestOAuthCallbackWithExtraProvider(t *testing.T) {
+	pat_test := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken: true,
+	})
+	defer pat_test.Close()
+	var tokenRequest url.Values
+	contractors := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tokenRequest = r.PostForm
+		w.Write([]byte(`{"access_token": "contractor_token"}`))
+	}))
+	defer contractors.Close()
+	provider_url, _ := url.Parse(contractors.URL)
+	pat_test.proxy.extraProviders = []providers.Provider{
+		NewExtraTestProvider(provider_url, "contractors", "michael.bland@gsa.gov"),
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback/contractors?code=callback_code&state=nonce:/foo", nil)
+	req.Host = "proxy.example.com"
+	req.AddCookie(pat_test.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "http://proxy.example.com/oauth2/callback/contractors", tokenRequest.Get("redirect_uri"))
+	// the default provider wasn't asked
+	assert.Equal(t, 0, len(pat_test.tokenRequest))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	session, _, err := pat_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "contractors", session.Provider)
+	assert.Equal(t, "contractor_token", session.AccessToken)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback/unknown?code=callback_code&state=nonce:/foo", nil)
+	pat_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestAuthenticateValidatesWithSessionProvider(t *testing.T) {
+	contractors := &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderID: "contractors"},
+		ValidToken:   false,
+	}
+	for provider, expected := range map[string]int{
+		"":            http.StatusAccepted,
+		"contractors": http.StatusForbidden,
+		"removed":     http.StatusForbidden,
+	} {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.extraProviders = []providers.Provider{contractors}
+		pc_test.proxy.CookieRefresh = time.Hour
+		startSession := &providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Provider: provider}
+		pc_test.SaveSession(startSession, time.Now().Add(-2*time.Hour))
+		assert.Equal(t, expected, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req), provider)
+	}
+}
+
+func TestAuthenticateChecksAccessRules(t *testing.T) {
+	admin, _ := parseAccessRule("path=^/admin/&group=ops")
+	writes, _ := parseAccessRule("method=POST&email=michael.bland@gsa.gov")
+	for path, expected := range map[string]error{
+		"/":            nil,
+		"/admin/users": errAccessDenied,
+		"/admin":       nil,
+	} {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.accessRules = []*AccessRule{admin, writes}
+		pc_test.req, _ = http.NewRequest("GET", path, nil)
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", Groups: []string{"users"}}, time.Now())
+		_, err := pc_test.proxy.authenticate(pc_test.rw, pc_test.req, pc_test.req)
+		assert.Equal(t, expected, err, path)
+	}
+
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.accessRules = []*AccessRule{admin, writes}
+	pc_test.req, _ = http.NewRequest("POST", "/", nil)
+	pc_test.SaveSession(&providers.SessionState{Email: "someone.else@gsa.gov"}, time.Now())
+	_, err := pc_test.proxy.authenticate(pc_test.rw, pc_test.req, pc_test.req)
+	assert.Equal(t, errAccessDenied, err)
+	pc_test.rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestProxyDeniedByAccessRule(t *testing.T) {
+	admin, _ := parseAccessRule("path=^/admin/&group=ops")
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.accessRules = []*AccessRule{admin}
+	pc_test.req, _ = http.NewRequest("GET", "/admin/users", nil)
+	pc_test.SaveSession(&providers.SessionState{Email: "michael.bland@gsa.gov"}, time.Now())
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusForbidden, pc_test.rw.Code)
+	assert.NotContains(t, pc_test.rw.Body.String(), "Sign in")
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req.URL.Path = "/oauth2/auth"
+	pc_test.proxy.accessRules[0].Path = regexp.MustCompile("^/oauth2/auth")
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusForbidden, pc_test.rw.Code)
+}
+
+// groupsTestProvider is a TestProvider whose sessions have groups
+type groupsTestProvider struct {
+	*TestProvider
+	groups []string
+}
+
+func (p *groupsTestProvider) Redeem(redirectURL, code, codeVerifier string) (*providers.SessionState, error) {
+	s, err := p.TestProvider.Redeem(redirectURL, code, codeVerifier)
+	if s != nil {
+		s.Groups = p.groups
+	}
+	return s, err
+}
+
+func TestAllowedGroupsSurviveTheSessionCookie(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			w.Write([]byte(`{"access_token": "my_auth_token"}`))
+			return
+		}
+		w.Write([]byte("upstream"))
+	}))
+	defer server.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, server.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.AllowedGroups = []string{"ops"}
+	assert.Equal(t, nil, opts.Validate())
+	serverURL, _ := url.Parse(server.URL)
+	opts.provider = &groupsTestProvider{NewTestProvider(serverURL, "michael.bland@gsa.gov"), []string{"ops"}}
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+}
+
+func TestAuthOnlyEndpointChecksAccessRulesOnOriginalURI(t *testing.T) {
+	admin, _ := parseAccessRule("path=^/admin/&method=POST&group=ops")
+	for _, tc := range []struct {
+		headers  map[string]string
+		expected int
+	}{
+		{map[string]string{}, http.StatusForbidden},
+		{map[string]string{"X-Original-URI": "/"}, http.StatusAccepted},
+		{map[string]string{"X-Original-URI": "/admin/users?page=2"}, http.StatusAccepted},
+		{map[string]string{"X-Original-URI": "/admin/users?page=2", "X-Original-Method": "POST"}, http.StatusForbidden},
+		{map[string]string{"X-Forwarded-Uri": "/admin/users", "X-Forwarded-Method": "POST"}, http.StatusForbidden},
+		{map[string]string{"X-Original-URI": "/public/../admin/users", "X-Original-Method": "POST"}, http.StatusForbidden},
+		{map[string]string{"X-Original-URI": "//admin/users", "X-Original-Method": "POST"}, http.StatusForbidden},
+		{map[string]string{"X-Original-URI": "/admin/./users/", "X-Original-Method": "POST"}, http.StatusForbidden},
+		{map[string]string{"X-Original-URI": "/%61dmin//users", "X-Original-Method": "POST"}, http.StatusForbidden},
+	} {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.accessRules = []*AccessRule{admin}
+		pc_test.proxy.AuthRequestOriginalURI = true
+		pc_test.req, _ = http.NewRequest("GET", "/oauth2/auth", nil)
+		for name, value := range tc.headers {
+			pc_test.req.Header.Set(name, value)
+		}
+		pc_test.SaveSession(&providers.SessionState{Email: "michael.bland@gsa.gov"}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		assert.Equal(t, tc.expected, pc_test.rw.Code, tc.headers)
+	}
+
+	// without the option the rules only see the /oauth2/auth request
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.accessRules = []*AccessRule{admin}
+	pc_test.req, _ = http.NewRequest("GET", "/oauth2/auth", nil)
+	pc_test.req.Header.Set("X-Original-URI", "/admin/users")
+	pc_test.req.Header.Set("X-Original-Method", "POST")
+	pc_test.SaveSession(&providers.SessionState{Email: "michael.bland@gsa.gov"}, time.Now())
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
+}
+
+func TestOAuthCallbackWithGenericProviderWithoutUserPath(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token": "imaginary_access_token", "expires_in": 3600}`))
+		case "/userinfo":
+			w.Write([]byte(`{"email": "michael.bland@gsa.gov"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
+	opts := NewOptions()
+	opts.Provider = "generic"
+	opts.LoginURL = idp.URL + "/authorize"
+	opts.RedeemURL = idp.URL + "/token"
+	opts.ProfileURL = idp.URL + "/userinfo"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/", rw.HeaderMap.Get("Location"))
+}
@@ -29,28 +29,64 @@ type Options struct {
 	TLSCertFile  string `flag:"tls-cert" cfg:"tls_cert_file"`
 	TLSKeyFile   string `flag:"tls-key" cfg:"tls_key_file"`
 
-	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
-	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
-	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
-	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
-	GitHubTeam               string   `flag:"github-team" cfg:"github_team"`
-	GoogleGroups             []string `flag:"google-group" cfg:"google_group"`
-	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
-	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
-	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
-	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
-	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
-	Footer                   string   `flag:"footer" cfg:"footer"`
-
-	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
-	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
-	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
-	CookieExpire   time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
-	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
-	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
-	CookieHttpOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	AuthenticatedEmailsFile  string        `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	AzureTenant              string        `flag:"azure-tenant" cfg:"azure_tenant"`
+	AzureV2                  bool          `flag:"azure-v2" cfg:"azure_v2"`
+	EmailDomains             []string      `flag:"email-domain" cfg:"email_domains"`
+	AllowedGroups            []string      `flag:"allowed-group" cfg:"allowed_groups"`
+	AccessRules              []string      `flag:"access-rule" cfg:"access_rules"`
+	AuthRequestOriginalURI   bool          `flag:"auth-request-original-uri" cfg:"auth_request_original_uri"`
+	GenericUserinfoMethod    string        `flag:"generic-userinfo-method" cfg:"generic_userinfo_method"`
+	GenericAuthStyle         string        `flag:"generic-auth-style" cfg:"generic_auth_style"`
+	GenericEmailPath         string        `flag:"generic-email-path" cfg:"generic_email_path"`
+	GenericUserPath          string        `flag:"generic-user-path" cfg:"generic_user_path"`
+	GenericGroupsPath        string        `flag:"generic-groups-path" cfg:"generic_groups_path"`
+	GitHubBaseURL            string        `flag:"github-base-url" cfg:"github_base_url"`
+	GitHubOrg                string        `flag:"github-org" cfg:"github_org"`
+	GitHubTeam               string        `flag:"github-team" cfg:"github_team"`
+	GitHubRepo               string        `flag:"github-repo" cfg:"github_repo"`
+	GitHubUsers              []string      `flag:"github-user" cfg:"github_users"`
+	GitLabBaseURL            string        `flag:"gitlab-base-url" cfg:"gitlab_base_url"`
+	GitLabGroups             []string      `flag:"gitlab-group" cfg:"gitlab_groups"`
+	GitLabProjects           []string      `flag:"gitlab-project" cfg:"gitlab_projects"`
+	GoogleGroups             []string      `flag:"google-group" cfg:"google_group"`
+	GoogleAdminEmail         string        `flag:"google-admin-email" cfg:"google_admin_email"`
+	GoogleGroupCacheTTL      time.Duration `flag:"google-group-cache-ttl" cfg:"google_group_cache_ttl"`
+	GoogleServiceAccountJSON string        `flag:"google-service-account-json" cfg:"google_service_account_json"`
+	KeycloakRealmURL         string        `flag:"keycloak-realm-url" cfg:"keycloak_realm_url"`
+	KeycloakGroups           []string      `flag:"keycloak-group" cfg:"keycloak_groups"`
+	KeycloakRoles            []string      `flag:"keycloak-role" cfg:"keycloak_roles"`
+	HtpasswdFile             string        `flag:"htpasswd-file" cfg:"htpasswd_file"`
+	DisplayHtpasswdForm      bool          `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
+	LDAPURL                  string        `flag:"ldap-url" cfg:"ldap_url"`
+	LDAPStartTLS             bool          `flag:"ldap-start-tls" cfg:"ldap_start_tls"`
+	LDAPBindDN               string        `flag:"ldap-bind-dn" cfg:"ldap_bind_dn"`
+	LDAPBindPassword         string        `flag:"ldap-bind-password" cfg:"ldap_bind_password" env:"OAUTH2_PROXY_LDAP_BIND_PASSWORD"`
+	LDAPBaseDN               string        `flag:"ldap-base-dn" cfg:"ldap_base_dn"`
+	LDAPUserFilter           string        `flag:"ldap-user-filter" cfg:"ldap_user_filter"`
+	LDAPEmailAttribute       string        `flag:"ldap-email-attribute" cfg:"ldap_email_attribute"`
+	LDAPGroupBaseDN          string        `flag:"ldap-group-base-dn" cfg:"ldap_group_base_dn"`
+	LDAPGroupFilter          string        `flag:"ldap-group-filter" cfg:"ldap_group_filter"`
+	LDAPGroupAttribute       string        `flag:"ldap-group-attribute" cfg:"ldap_group_attribute"`
+	CustomTemplatesDir       string        `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
+	Footer                   string        `flag:"footer" cfg:"footer"`
+	WhitelistDomains         []string      `flag:"whitelist-domain" cfg:"whitelist_domains"`
+
+	CookieName       string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
+	CookieSecret     string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
+	CookieSecretsOld []string      `flag:"cookie-secret-old" cfg:"cookie_secrets_old"`
+	CookieDomain     string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
+	CookieExpire     time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
+	CookieRefresh    time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
+	CookieSecure     bool          `flag:"cookie-secure" cfg:"cookie_secure"`
+	CookieHttpOnly   bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+
+	SessionStoreType   string `flag:"session-store-type" cfg:"session_store_type"`
+	RedisConnectionURL string `flag:"redis-connection-url" cfg:"redis_connection_url" env:"OAUTH2_PROXY_REDIS_CONNECTION_URL"`
 
 	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
+	VirtualHosts          []string `flag:"virtual-host" cfg:"virtual_hosts"`
+	UpstreamsFile         string   `flag:"upstreams-file" cfg:"upstreams_file"`
 	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
 	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
 	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
@@ -61,6 +97,8 @@ type Options struct {
 	SSLInsecureSkipVerify bool     `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify"`
 	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
 	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	SkipJwtBearerTokens   bool     `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens"`
+	ExtraJwtIssuers       []string `flag:"extra-jwt-issuers" cfg:"extra_jwt_issuers"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
@@ -71,8 +109,15 @@ type Options struct {
 	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
 	ProtectedResource string `flag:"resource" cfg:"resource"`
 	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
+	IntrospectionURL  string `flag:"introspection-url" cfg:"introspection_url"`
 	Scope             string `flag:"scope" cfg:"scope"`
 	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt"`
+	OIDCLogout        bool   `flag:"oidc-logout" cfg:"oidc_logout"`
+	OIDCGroupsClaim   string `flag:"oidc-groups-claim" cfg:"oidc_groups_claim"`
+	UsePKCE           bool   `flag:"use-pkce" cfg:"use_pkce"`
+	PublicClient      bool   `flag:"public-client" cfg:"public_client"`
+
+	ExtraProviders []string `flag:"extra-provider" cfg:"extra_providers"`
 
 	RequestLogging       bool   `flag:"request-logging" cfg:"request_logging"`
 	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
@@ -86,6 +131,14 @@ type Options struct {
 	provider      providers.Provider
 	signatureData *SignatureData
 	oidcVerifier  *oidc.IDTokenVerifier
+	// end_session_endpoint from the oidc discovery document
+	oidcEndSessionURL  string
+	jwtBearerVerifiers []*oidc.IDTokenVerifier
+	extraProviders     []providers.Provider
+	ldapAuthenticator  *LDAPAuthenticator
+	accessRules        []*AccessRule
+	virtualHosts       []*VirtualHost
+	upstreamConfigs    []*UpstreamConfig
 }
 
 type SignatureData struct {
@@ -99,11 +152,17 @@ func NewOptions() *Options {
 		HttpAddress:          "127.0.0.1:4180",
 		HttpsAddress:         ":443",
 		DisplayHtpasswdForm:  true,
+		LDAPUserFilter:       "(uid=%s)",
+		LDAPEmailAttribute:   "mail",
+		LDAPGroupFilter:      "(member=%s)",
+		LDAPGroupAttribute:   "cn",
 		CookieName:           "_oauth2_proxy",
 		CookieSecure:         true,
 		CookieHttpOnly:       true,
 		CookieExpire:         time.Duration(168) * time.Hour,
 		CookieRefresh:        time.Duration(0),
+		GoogleGroupCacheTTL:  time.Duration(5) * time.Minute,
+		SessionStoreType:     "cookie",
 		SetXAuthRequest:      false,
 		SkipAuthPreflight:    false,
 		PassBasicAuth:        true,
@@ -111,6 +170,7 @@ func NewOptions() *Options {
 		PassAccessToken:      false,
 		PassHostHeader:       true,
 		ApprovalPrompt:       "force",
+		OIDCGroupsClaim:      "groups",
 		RequestLogging:       true,
 		RequestLoggingFormat: defaultRequestLoggingFormat,
 	}
@@ -141,10 +201,10 @@ func (o *Options) Validate() error {
 	if o.ClientID == "" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	if o.ClientSecret == "" {
+	if o.ClientSecret == "" && !o.PublicClient {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
-	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
+	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" && o.LDAPURL == "" {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required."+
 			"\n      use email-domain=* to authorize all email addresses")
 	}
@@ -160,6 +220,13 @@ func (o *Options) Validate() error {
 		})
 		o.LoginURL = provider.Endpoint().AuthURL
 		o.RedeemURL = provider.Endpoint().TokenURL
+		var discovery struct {
+			EndSessionURL string `json:"end_session_endpoint"`
+		}
+		if err := provider.Claims(&discovery); err != nil {
+			return err
+		}
+		o.oidcEndSessionURL = discovery.EndSessionURL
 		if o.Scope == "" {
 			o.Scope = "openid email profile"
 		}
@@ -188,31 +255,7 @@ func (o *Options) Validate() error {
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
 	msgs = parseProviderInfo(o, msgs)
-
-	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
-		valid_cookie_secret_size := false
-		for _, i := range []int{16, 24, 32} {
-			if len(secretBytes(o.CookieSecret)) == i {
-				valid_cookie_secret_size = true
-			}
-		}
-		var decoded bool
-		if string(secretBytes(o.CookieSecret)) != o.CookieSecret {
-			decoded = true
-		}
-		if valid_cookie_secret_size == false {
-			var suffix string
-			if decoded {
-				suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", o.CookieSecret)
-			}
-			msgs = append(msgs, fmt.Sprintf(
-				"cookie_secret must be 16, 24, or 32 bytes "+
-					"to create an AES cipher when "+
-					"pass_access_token == true or "+
-					"cookie_refresh != 0, but is %d bytes.%s",
-				len(secretBytes(o.CookieSecret)), suffix))
-		}
-	}
+	msgs = parseExtraProviders(o, msgs)
 
 	if o.CookieRefresh >= o.CookieExpire {
 		msgs = append(msgs, fmt.Sprintf(
@@ -236,6 +279,18 @@ func (o *Options) Validate() error {
 
 	msgs = parseSignatureKey(o, msgs)
 	msgs = validateCookieName(o, msgs)
+	msgs = validateSessionStore(o, msgs)
+	msgs = parseJwtIssuers(o, msgs)
+	msgs = parseLDAP(o, msgs)
+	msgs = parseAccessRules(o, msgs)
+	msgs = parseVirtualHosts(o, msgs)
+	msgs = parseUpstreamsFile(o, msgs)
+
+	if o.needsCookieCipher() {
+		for _, secret := range append([]string{o.CookieSecret}, o.CookieSecretsOld...) {
+			msgs = validateCookieSecretSize(secret, msgs)
+		}
+	}
 
 	if len(msgs) != 0 {
 		return fmt.Errorf("Invalid configuration:\n  %s",
@@ -244,44 +299,422 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// needsCookieCipher returns whether session cookies have to be encrypted:
+// only encrypted cookies keep the tokens, which the oidc logout and
+// keycloak's rechecks on refresh need, and the groups that the allowed
+// groups, access rules, virtual hosts and upstreams check
+func (o *Options) needsCookieCipher() bool {
+	if o.PassAccessToken || o.CookieRefresh != time.Duration(0) || o.OIDCLogout || len(o.AllowedGroups) != 0 {
+		return true
+	}
+	for _, p := range append([]providers.Provider{o.provider}, o.extraProviders...) {
+		if kp, ok := p.(*providers.KeycloakProvider); ok && (len(kp.Groups) != 0 || len(kp.Roles) != 0) {
+			return true
+		}
+	}
+	for _, r := range o.accessRules {
+		if len(r.Groups) != 0 {
+			return true
+		}
+	}
+	for _, vh := range o.virtualHosts {
+		if len(vh.Rule.Groups) != 0 {
+			return true
+		}
+	}
+	for _, c := range o.upstreamConfigs {
+		if len(c.AllowedGroups) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func parseProviderInfo(o *Options, msgs []string) []string {
 	p := &providers.ProviderData{
 		Scope:          o.Scope,
 		ClientID:       o.ClientID,
 		ClientSecret:   o.ClientSecret,
 		ApprovalPrompt: o.ApprovalPrompt,
+		PublicClient:   o.PublicClient,
 	}
 	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
 	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
 	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
 	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
+	if o.IntrospectionURL != "" {
+		p.IntrospectURL, msgs = parseURL(o.IntrospectionURL, "introspection", msgs)
+	}
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
 
 	o.provider = providers.New(o.Provider, p)
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
-		p.Configure(o.AzureTenant)
+		if o.AzureV2 {
+			p.ConfigureV2(o.AzureTenant)
+		} else {
+			p.Configure(o.AzureTenant)
+		}
+	case *providers.GenericProvider:
+		msgs = configureGeneric(p, o.GenericUserinfoMethod, o.GenericAuthStyle,
+			o.GenericEmailPath, o.GenericUserPath, o.GenericGroupsPath, msgs)
 	case *providers.GitHubProvider:
-		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+		msgs = configureGitHub(p, o.GitHubBaseURL, o.GitHubOrg, o.GitHubTeam, o.GitHubRepo, o.GitHubUsers, msgs)
+	case *providers.GitLabProvider:
+		msgs = configureGitLab(p, o.GitLabBaseURL, o.GitLabGroups, o.GitLabProjects, msgs)
 	case *providers.GoogleProvider:
 		if o.GoogleServiceAccountJSON != "" {
 			file, err := os.Open(o.GoogleServiceAccountJSON)
 			if err != nil {
 				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
 			} else {
-				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file, o.GoogleGroupCacheTTL)
 			}
 		}
+	case *providers.KeycloakProvider:
+		msgs = configureKeycloak(p, o.KeycloakRealmURL, o.KeycloakGroups, o.KeycloakRoles, msgs)
 	case *providers.OIDCProvider:
 		if o.oidcVerifier == nil {
 			msgs = append(msgs, "oidc provider requires an oidc issuer URL")
 		} else {
 			p.Verifier = o.oidcVerifier
 		}
+		if o.OIDCGroupsClaim != "" {
+			p.GroupsClaim = o.OIDCGroupsClaim
+		}
+		p.ConfigurePublicClient()
+		if o.OIDCLogout {
+			if o.oidcEndSessionURL == "" {
+				msgs = append(msgs, "oidc-logout requires an end_session_endpoint from the oidc issuer")
+			} else {
+				p.EndSessionURL, msgs = parseURL(o.oidcEndSessionURL, "end-session", msgs)
+			}
+		}
+	}
+	return msgs
+}
+
+func configureGeneric(p *providers.GenericProvider, method, authStyle, emailPath, userPath, groupsPath string, msgs []string) []string {
+	for _, u := range []struct {
+		url  *url.URL
+		name string
+	}{
+		{p.LoginURL, "login-url"},
+		{p.RedeemURL, "redeem-url"},
+		{p.ProfileURL, "profile-url"},
+	} {
+		// url is nil when it didn't parse
+		if u.url == nil || u.url.String() == "" {
+			msgs = append(msgs, fmt.Sprintf("generic provider requires a %s", u.name))
+		}
+	}
+	switch strings.ToUpper(method) {
+	case "", "GET", "POST":
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid generic-userinfo-method %q: expected GET or POST", method))
+	}
+	switch strings.ToLower(authStyle) {
+	case "", "bearer", "token", "query":
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid generic-auth-style %q: expected bearer, token or query", authStyle))
+	}
+	p.SetUserinfoRequest(method, authStyle)
+	p.SetSelectors(emailPath, userPath, groupsPath)
+	return msgs
+}
+
+func configureGitHub(p *providers.GitHubProvider, baseURL, org, team, repo string, users []string, msgs []string) []string {
+	if baseURL != "" {
+		var u *url.URL
+		u, msgs = parseURL(baseURL, "github-base", msgs)
+		if u != nil {
+			p.Configure(u)
+		}
+	}
+	if repo != "" && len(strings.Split(strings.Trim(repo, "/"), "/")) != 2 {
+		msgs = append(msgs, fmt.Sprintf("invalid github-repo %q: expected owner/repo", repo))
+	}
+	p.SetOrgTeam(org, team)
+	p.SetRepo(strings.Trim(repo, "/"))
+	p.SetUsers(users)
+	return msgs
+}
+
+func configureGitLab(p *providers.GitLabProvider, baseURL string, groups, projectSpecs []string, msgs []string) []string {
+	if baseURL != "" {
+		var u *url.URL
+		u, msgs = parseURL(baseURL, "gitlab-base", msgs)
+		if u != nil {
+			p.Configure(u)
+		}
+	}
+	var projects []providers.GitLabProject
+	for _, spec := range projectSpecs {
+		project, err := providers.ParseGitLabProject(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid gitlab-project %q: %s", spec, err))
+			continue
+		}
+		projects = append(projects, project)
+	}
+	p.SetGroupsProjects(groups, projects)
+	return msgs
+}
+
+func configureKeycloak(p *providers.KeycloakProvider, realmURL string, groups, roles []string, msgs []string) []string {
+	if realmURL != "" {
+		var u *url.URL
+		u, msgs = parseURL(realmURL, "keycloak-realm", msgs)
+		if u != nil {
+			p.Configure(u)
+		}
+	}
+	if p.LoginURL.String() == "" || p.RedeemURL.String() == "" {
+		msgs = append(msgs, "keycloak provider requires a keycloak-realm-url")
+	}
+	p.SetAllowedGroupsRoles(groups, roles)
+	return msgs
+}
+
+var providerIDRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// parseExtraProviders configures the providers offered next to the default
+// one. Each is given as query parameters named after the corresponding
+// options, ie: "id=contractors&provider=github&client-id=...&client-secret=..."
+func parseExtraProviders(o *Options, msgs []string) []string {
+	o.extraProviders = nil
+	seen := make(map[string]bool)
+	for _, spec := range o.ExtraProviders {
+		v, err := url.ParseQuery(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid extra-provider spec %q: %s", spec, err))
+			continue
+		}
+		id := v.Get("id")
+		if !providerIDRegex.MatchString(id) {
+			msgs = append(msgs, fmt.Sprintf("extra-provider id must be letters, digits, \"-\" or \"_\": %q", spec))
+			continue
+		}
+		if seen[id] {
+			msgs = append(msgs, fmt.Sprintf("duplicate extra-provider id %q", id))
+			continue
+		}
+		seen[id] = true
+
+		p := &providers.ProviderData{
+			ProviderID:     id,
+			Scope:          v.Get("scope"),
+			ClientID:       v.Get("client-id"),
+			ClientSecret:   v.Get("client-secret"),
+			ApprovalPrompt: o.ApprovalPrompt,
+			PublicClient:   v.Get("public-client") == "true",
+		}
+		if p.ClientID == "" {
+			msgs = append(msgs, fmt.Sprintf("missing client-id for extra-provider %q", id))
+		}
+		if p.ClientSecret == "" && !p.PublicClient {
+			msgs = append(msgs, fmt.Sprintf("missing client-secret for extra-provider %q", id))
+		}
+
+		loginURL, redeemURL := v.Get("login-url"), v.Get("redeem-url")
+		var verifier *oidc.IDTokenVerifier
+		if issuerURL := v.Get("oidc-issuer-url"); issuerURL != "" {
+			provider, err := oidc.NewProvider(context.Background(), issuerURL)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("error discovering oidc issuer %q of extra-provider %q: %s", issuerURL, id, err))
+				continue
+			}
+			verifier = provider.Verifier(&oidc.Config{
+				ClientID: p.ClientID,
+			})
+			loginURL = provider.Endpoint().AuthURL
+			redeemURL = provider.Endpoint().TokenURL
+			if p.Scope == "" {
+				p.Scope = "openid email profile"
+			}
+		}
+		parsed := len(msgs)
+		p.LoginURL, msgs = parseURL(loginURL, "login", msgs)
+		p.RedeemURL, msgs = parseURL(redeemURL, "redeem", msgs)
+		p.ProfileURL, msgs = parseURL(v.Get("profile-url"), "profile", msgs)
+		p.ValidateURL, msgs = parseURL(v.Get("validate-url"), "validate", msgs)
+		if len(msgs) != parsed {
+			// the providers expect their urls to be set
+			continue
+		}
+
+		provider := providers.New(v.Get("provider"), p)
+		switch p := provider.(type) {
+		case *providers.AzureProvider:
+			if v.Get("azure-v2") == "true" {
+				p.ConfigureV2(v.Get("azure-tenant"))
+			} else {
+				p.Configure(v.Get("azure-tenant"))
+			}
+		case *providers.GenericProvider:
+			msgs = configureGeneric(p, v.Get("generic-userinfo-method"), v.Get("generic-auth-style"),
+				v.Get("generic-email-path"), v.Get("generic-user-path"), v.Get("generic-groups-path"), msgs)
+		case *providers.GitHubProvider:
+			msgs = configureGitHub(p, v.Get("github-base-url"), v.Get("github-org"), v.Get("github-team"),
+				v.Get("github-repo"), v["github-user"], msgs)
+		case *providers.GitLabProvider:
+			msgs = configureGitLab(p, v.Get("gitlab-base-url"), v["gitlab-group"], v["gitlab-project"], msgs)
+		case *providers.KeycloakProvider:
+			msgs = configureKeycloak(p, v.Get("keycloak-realm-url"), v["keycloak-group"], v["keycloak-role"], msgs)
+		case *providers.OIDCProvider:
+			if verifier == nil {
+				msgs = append(msgs, fmt.Sprintf("oidc extra-provider %q requires an oidc-issuer-url", id))
+			}
+			p.Verifier = verifier
+			if o.OIDCGroupsClaim != "" {
+				p.GroupsClaim = o.OIDCGroupsClaim
+			}
+			p.ConfigurePublicClient()
+		}
+		if name := v.Get("name"); name != "" {
+			provider.Data().ProviderName = name
+		}
+		o.extraProviders = append(o.extraProviders, provider)
+	}
+	return msgs
+}
+
+func parseJwtIssuers(o *Options, msgs []string) []string {
+	if !o.SkipJwtBearerTokens {
+		return msgs
+	}
+	o.jwtBearerVerifiers = nil
+	if o.oidcVerifier != nil {
+		o.jwtBearerVerifiers = append(o.jwtBearerVerifiers, o.oidcVerifier)
+	}
+	for _, jwtIssuer := range o.ExtraJwtIssuers {
+		components := strings.SplitN(jwtIssuer, "=", 2)
+		if len(components) != 2 || components[0] == "" || components[1] == "" {
+			msgs = append(msgs, "invalid extra-jwt-issuers issuer=audience spec: "+jwtIssuer)
+			continue
+		}
+		issuer, audience := components[0], components[1]
+		provider, err := oidc.NewProvider(context.Background(), issuer)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error discovering jwt issuer %q: %s", issuer, err))
+			continue
+		}
+		o.jwtBearerVerifiers = append(o.jwtBearerVerifiers, provider.Verifier(&oidc.Config{
+			ClientID: audience,
+		}))
+	}
+	if len(o.jwtBearerVerifiers) == 0 {
+		msgs = append(msgs, "skip-jwt-bearer-tokens requires an oidc-issuer-url or extra-jwt-issuers")
+	}
+	return msgs
+}
+
+func parseLDAP(o *Options, msgs []string) []string {
+	if o.LDAPURL == "" {
+		return msgs
+	}
+	ldapURL, err := url.Parse(o.LDAPURL)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error parsing ldap-url=%q %s", o.LDAPURL, err))
+	}
+	if ldapURL.Scheme != "ldap" && ldapURL.Scheme != "ldaps" {
+		return append(msgs, fmt.Sprintf("invalid ldap-url %q: expected ldap:// or ldaps://", o.LDAPURL))
+	}
+	if o.LDAPStartTLS && ldapURL.Scheme == "ldaps" {
+		msgs = append(msgs, "ldap-start-tls cannot be used with an ldaps:// ldap-url")
+	}
+	if o.LDAPBaseDN == "" {
+		msgs = append(msgs, "missing setting: ldap-base-dn")
+	}
+	o.ldapAuthenticator = &LDAPAuthenticator{
+		URL:            ldapURL,
+		StartTLS:       o.LDAPStartTLS,
+		BindDN:         o.LDAPBindDN,
+		BindPassword:   o.LDAPBindPassword,
+		BaseDN:         o.LDAPBaseDN,
+		UserFilter:     o.LDAPUserFilter,
+		EmailAttribute: o.LDAPEmailAttribute,
+		GroupBaseDN:    o.LDAPGroupBaseDN,
+		GroupFilter:    o.LDAPGroupFilter,
+		GroupAttribute: o.LDAPGroupAttribute,
+	}
+	return msgs
+}
+
+func parseAccessRules(o *Options, msgs []string) []string {
+	for _, spec := range o.AccessRules {
+		rule, err := parseAccessRule(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid access-rule %q: %s", spec, err))
+			continue
+		}
+		o.accessRules = append(o.accessRules, rule)
+	}
+	return msgs
+}
+
+func parseVirtualHosts(o *Options, msgs []string) []string {
+	for _, spec := range o.VirtualHosts {
+		vh, err := parseVirtualHost(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid virtual-host %q: %s", spec, err))
+			continue
+		}
+		o.virtualHosts = append(o.virtualHosts, vh)
+	}
+	sortVirtualHosts(o.virtualHosts)
+	return msgs
+}
+
+func parseUpstreamsFile(o *Options, msgs []string) []string {
+	if o.UpstreamsFile == "" {
+		return msgs
+	}
+	configs, err := loadUpstreamsFile(o.UpstreamsFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid upstreams-file %s: %s", o.UpstreamsFile, err))
+	}
+	// a host's path is served by one upstream
+	type route struct{ host, path string }
+	routes := make(map[route]bool)
+	for _, u := range o.proxyURLs {
+		routes[route{"", upstreamPath(u)}] = true
+	}
+	for _, vh := range o.virtualHosts {
+		for _, u := range vh.Upstreams {
+			routes[route{vh.Host, upstreamPath(u)}] = true
+		}
+	}
+	for i, c := range configs {
+		r := route{c.Host, c.Path}
+		if routes[r] {
+			return append(msgs, fmt.Sprintf("invalid upstreams-file %s: upstream %d: path %q of host %q already has an upstream",
+				o.UpstreamsFile, i+1, c.Path, c.Host))
+		}
+		routes[r] = true
 	}
+	o.upstreamConfigs = configs
+	// upstreams for other hosts get a virtual host without requirements
+	for _, c := range configs {
+		if c.Host != "" && findVirtualHost(o.virtualHosts, c.Host) == nil {
+			o.virtualHosts = append(o.virtualHosts, &VirtualHost{
+				Host: c.Host,
+				Rule: &AccessRule{Host: c.Host},
+			})
+		}
+	}
+	sortVirtualHosts(o.virtualHosts)
 	return msgs
 }
 
+// upstreamPath returns the path the upstream is served at, see handleUpstream
+func upstreamPath(u *url.URL) string {
+	if u.Scheme == "file" && u.Fragment != "" {
+		return u.Fragment
+	}
+	return u.Path
+}
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
@@ -311,6 +744,19 @@ func validateCookieName(o *Options, msgs []string) []string {
 	return msgs
 }
 
+func validateSessionStore(o *Options, msgs []string) []string {
+	switch o.SessionStoreType {
+	case "cookie":
+	case "redis":
+		if o.RedisConnectionURL == "" {
+			msgs = append(msgs, "missing setting: redis-connection-url")
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf("unknown session-store-type: %q", o.SessionStoreType))
+	}
+	return msgs
+}
+
 func addPadding(secret string) string {
 	padding := len(secret) % 4
 	switch padding {
@@ -325,6 +771,35 @@ func addPadding(secret string) string {
 	}
 }
 
+// validateCookieSecretSize checks that the secret makes an AES key, 16, 24
+// or 32 bytes once decoded
+func validateCookieSecretSize(secret string, msgs []string) []string {
+	valid_cookie_secret_size := false
+	for _, i := range []int{16, 24, 32} {
+		if len(secretBytes(secret)) == i {
+			valid_cookie_secret_size = true
+		}
+	}
+	var decoded bool
+	if string(secretBytes(secret)) != secret {
+		decoded = true
+	}
+	if valid_cookie_secret_size == false {
+		var suffix string
+		if decoded {
+			suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", secret)
+		}
+		msgs = append(msgs, fmt.Sprintf(
+			"cookie_secret must be 16, 24, or 32 bytes "+
+				"to create an AES cipher when "+
+				"pass_access_token == true, "+
+				"cookie_refresh != 0, oidc_logout == true, "+
+				"or groups or keycloak roles are checked, but is %d bytes.%s",
+			len(secretBytes(secret)), suffix))
+	}
+	return msgs
+}
+
 // secretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
 func secretBytes(secret string) []byte {
 	b, err := base64.URLEncoding.DecodeString(addPadding(secret))
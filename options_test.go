@@ -4,10 +4,12 @@ import (
 	"crypto"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,6 +43,16 @@ func TestNewOptions(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestPublicClientDoesNotRequireClientSecret(t *testing.T) {
+	o := testOptions()
+	o.ClientSecret = ""
+	assert.NotEqual(t, nil, o.Validate())
+
+	o.PublicClient = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, true, o.provider.Data().PublicClient)
+}
+
 func TestGoogleGroupOptions(t *testing.T) {
 	o := testOptions()
 	o.GoogleGroups = []string{"googlegroup"}
@@ -189,6 +201,27 @@ func TestCookieRefreshMustBeLessThanCookieExpire(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+func TestMultipleCookieSecrets(t *testing.T) {
+	o := testOptions()
+	o.PassAccessToken = true
+	o.CookieSecret = "16 bytes AES-128"
+	o.CookieSecretsOld = []string{"32 byte secret for AES-256------"}
+	assert.Equal(t, nil, o.Validate())
+
+	o.CookieSecretsOld = []string{"cookie of invalid length,"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "but is 25 bytes.")
+
+	// commas are part of the secret
+	o = testOptions()
+	o.CookieSecret = "comma,separated"
+	assert.Equal(t, nil, o.Validate())
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+	assert.Equal(t, "comma,separated", proxy.CookieSeed)
+	assert.Equal(t, 0, len(proxy.OldCookieSeeds))
+}
+
 func TestBase64CookieSecret(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -251,3 +284,362 @@ func TestValidateCookieBadName(t *testing.T) {
 	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
+
+func TestValidateSessionStore(t *testing.T) {
+	o := testOptions()
+	o.SessionStoreType = "redis"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  missing setting: redis-connection-url")
+
+	o.RedisConnectionURL = "redis://127.0.0.1:6379"
+	assert.Equal(t, nil, o.Validate())
+
+	o.SessionStoreType = "memcache"
+	err = o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  unknown session-store-type: \"memcache\"")
+}
+
+func TestValidateExtraJwtIssuers(t *testing.T) {
+	o := testOptions()
+	o.SkipJwtBearerTokens = true
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  skip-jwt-bearer-tokens requires an oidc-issuer-url or extra-jwt-issuers")
+
+	o.ExtraJwtIssuers = []string{"https://issuer.example.com"}
+	err = o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid extra-jwt-issuers issuer=audience spec: https://issuer.example.com\n"+
+		"  skip-jwt-bearer-tokens requires an oidc-issuer-url or extra-jwt-issuers")
+}
+
+func TestExtraProviders(t *testing.T) {
+	o := testOptions()
+	o.ExtraProviders = []string{
+		"id=contractors&provider=github&client-id=abc&client-secret=xyz&github-org=acme",
+		"id=partners&provider=gitlab&name=Partners&client-id=def&public-client=true&scope=read_user",
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.extraProviders))
+
+	p := o.extraProviders[0].Data()
+	assert.Equal(t, "contractors", p.ProviderID)
+	assert.Equal(t, "GitHub", p.ProviderName)
+	assert.Equal(t, "abc", p.ClientID)
+	assert.Equal(t, "xyz", p.ClientSecret)
+	assert.Equal(t, "github.com", p.LoginURL.Host)
+
+	p = o.extraProviders[1].Data()
+	assert.Equal(t, "partners", p.ProviderID)
+	assert.Equal(t, "Partners", p.ProviderName)
+	assert.Equal(t, true, p.PublicClient)
+	assert.Equal(t, "read_user", p.Scope)
+}
+
+func TestExtraProvidersInvalid(t *testing.T) {
+	o := testOptions()
+	o.ExtraProviders = []string{
+		"provider=github&client-id=abc&client-secret=xyz",
+		"id=contractors&provider=github",
+		"id=contractors&provider=github&client-id=abc&client-secret=xyz",
+		"id=oidc&provider=oidc&client-id=abc&client-secret=xyz",
+	}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  extra-provider id must be letters, digits, \"-\" or \"_\": \"provider=github&client-id=abc&client-secret=xyz\"\n"+
+		"  missing client-id for extra-provider \"contractors\"\n"+
+		"  missing client-secret for extra-provider \"contractors\"\n"+
+		"  duplicate extra-provider id \"contractors\"\n"+
+		"  oidc extra-provider \"oidc\" requires an oidc-issuer-url")
+}
+
+func TestGenericProvider(t *testing.T) {
+	o := testOptions()
+	o.Provider = "generic"
+	o.LoginURL = "https://idp.example.com/oauth/authorize"
+	o.RedeemURL = "https://idp.example.com/oauth/token"
+	o.ProfileURL = "https://idp.example.com/api/me"
+	o.GenericUserinfoMethod = "post"
+	o.GenericAuthStyle = "query"
+	o.GenericEmailPath = "data.email"
+	o.GenericGroupsPath = "data.teams.*.name"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.GenericProvider)
+	assert.Equal(t, "POST", p.UserinfoMethod)
+	assert.Equal(t, "query", p.AuthStyle)
+	assert.Equal(t, "data.email", p.EmailPath)
+	assert.Equal(t, "", p.UserPath)
+	assert.Equal(t, "data.teams.*.name", p.GroupsPath)
+
+	o = testOptions()
+	o.Provider = "generic"
+	o.GenericUserinfoMethod = "PUT"
+	o.GenericAuthStyle = "cookie"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  generic provider requires a login-url\n"+
+		"  generic provider requires a redeem-url\n"+
+		"  generic provider requires a profile-url\n"+
+		"  invalid generic-userinfo-method \"PUT\": expected GET or POST\n"+
+		"  invalid generic-auth-style \"cookie\": expected bearer, token or query")
+
+	o = testOptions()
+	o.Provider = "generic"
+	o.LoginURL = "http://a/%zz"
+	o.RedeemURL = "https://idp.example.com/oauth/token"
+	o.ProfileURL = "https://idp.example.com/api/me"
+	// an error rather than a panic, the parse error varies by Go version
+	err = o.Validate()
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "error parsing login-url=\"http://a/%zz\"")
+		assert.Contains(t, err.Error(), "generic provider requires a login-url")
+	}
+
+	o = testOptions()
+	o.ExtraProviders = []string{
+		"id=idp&provider=generic&client-id=abc&client-secret=xyz&login-url=http://a/%25zz",
+		"id=corp&provider=google&client-id=abc&client-secret=xyz&redeem-url=http://a/%25zz",
+	}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 0, len(o.extraProviders))
+}
+
+func TestLDAP(t *testing.T) {
+	o := testOptions()
+	o.EmailDomains = nil
+	o.LDAPURL = "ldaps://ldap.example.com"
+	o.LDAPBaseDN = "ou=people,dc=example,dc=com"
+	o.LDAPGroupBaseDN = "ou=groups,dc=example,dc=com"
+	assert.Equal(t, nil, o.Validate())
+	a := o.ldapAuthenticator
+	assert.Equal(t, "ldaps://ldap.example.com", a.URL.String())
+	assert.Equal(t, "(uid=%s)", a.UserFilter)
+	assert.Equal(t, "mail", a.EmailAttribute)
+	assert.Equal(t, "ou=groups,dc=example,dc=com", a.GroupBaseDN)
+	assert.Equal(t, "(member=%s)", a.GroupFilter)
+	assert.Equal(t, "cn", a.GroupAttribute)
+
+	o = testOptions()
+	o.LDAPURL = "ldaps://ldap.example.com"
+	o.LDAPStartTLS = true
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  ldap-start-tls cannot be used with an ldaps:// ldap-url\n"+
+		"  missing setting: ldap-base-dn")
+
+	o = testOptions()
+	o.LDAPURL = "https://ldap.example.com"
+	err = o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid ldap-url \"https://ldap.example.com\": expected ldap:// or ldaps://")
+}
+
+func TestKeycloakRealmURL(t *testing.T) {
+	o := testOptions()
+	o.Provider = "keycloak"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  keycloak provider requires a keycloak-realm-url")
+
+	o = testOptions()
+	o.Provider = "keycloak"
+	o.KeycloakRealmURL = "https://keycloak.example.com/auth/realms/myrealm"
+	o.KeycloakRoles = []string{"admin"}
+	// roles need encrypted cookies
+	o.CookieSecret = "0123456789abcdefabcd"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.KeycloakProvider)
+	assert.Equal(t, "https://keycloak.example.com/auth/realms/myrealm/protocol/openid-connect/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, []string{"admin"}, p.Roles)
+}
+
+func TestAzureV2(t *testing.T) {
+	o := testOptions()
+	o.Provider = "azure"
+	o.AzureTenant = "example"
+	o.AzureV2 = true
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.AzureProvider)
+	assert.Equal(t, true, p.V2)
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me", p.Data().ProfileURL.String())
+
+	o = testOptions()
+	o.ExtraProviders = []string{"id=partners&provider=azure&client-id=abc&client-secret=xyz&azure-tenant=partner&azure-v2=true"}
+	assert.Equal(t, nil, o.Validate())
+	p = o.extraProviders[0].(*providers.AzureProvider)
+	assert.Equal(t, true, p.V2)
+	assert.Equal(t, "https://login.microsoftonline.com/partner/oauth2/v2.0/token", p.Data().RedeemURL.String())
+}
+
+func TestGitHubRestrictions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "https://github.example.com"
+	o.GitHubOrg = "acme"
+	o.GitHubRepo = "acme/widgets"
+	o.GitHubUsers = []string{"mbland"}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.GitHubProvider)
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3/", p.Data().ValidateURL.String())
+	assert.Equal(t, "acme", p.Org)
+	assert.Equal(t, "acme/widgets", p.Repo)
+	assert.Equal(t, []string{"mbland"}, p.Users)
+	assert.Equal(t, "user:email read:org", p.Data().Scope)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubRepo = "widgets"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid github-repo \"widgets\": expected owner/repo")
+}
+
+func TestGitLabGroupsAndProjects(t *testing.T) {
+	o := testOptions()
+	o.Provider = "gitlab"
+	o.GitLabBaseURL = "https://gitlab.example.com"
+	o.GitLabGroups = []string{"group/subgroup"}
+	o.GitLabProjects = []string{"group/project=developer"}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.GitLabProvider)
+	assert.Equal(t, "https://gitlab.example.com/oauth/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, []string{"group/subgroup"}, p.Groups)
+	assert.Equal(t, []providers.GitLabProject{{Path: "group/project", AccessLevel: 30}}, p.Projects)
+
+	o = testOptions()
+	o.Provider = "gitlab"
+	o.GitLabProjects = []string{"group/project=admin"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid gitlab-project \"group/project=admin\": invalid access level \"admin\"")
+}
+
+func TestAccessRules(t *testing.T) {
+	o := testOptions()
+	// groups need encrypted cookies
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.AccessRules = []string{"path=^/admin/&group=ops", "host=*.example.com"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.accessRules))
+	assert.Equal(t, []string{"ops"}, o.accessRules[0].Groups)
+	assert.Equal(t, "*.example.com", o.accessRules[1].Host)
+
+	o = testOptions()
+	o.AccessRules = []string{"path=^/admin/&team=ops"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid access-rule \"path=^/admin/&team=ops\": unknown parameter \"team\"")
+}
+
+func TestVirtualHosts(t *testing.T) {
+	o := testOptions()
+	// groups need encrypted cookies
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.VirtualHosts = []string{
+		"host=*.example.com&upstream=http://127.0.0.1:5601/",
+		"host=grafana.example.com&upstream=http://127.0.0.1:3000/&group=ops",
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.virtualHosts))
+	assert.Equal(t, "grafana.example.com", o.virtualHosts[0].Host)
+	assert.Equal(t, []string{"ops"}, o.virtualHosts[0].Rule.Groups)
+	assert.Equal(t, "*.example.com", o.virtualHosts[1].Host)
+
+	o = testOptions()
+	o.VirtualHosts = []string{"host=grafana.example.com"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid virtual-host \"host=grafana.example.com\": missing upstream")
+}
+
+func TestUpstreamsFile(t *testing.T) {
+	path := writeUpstreamsFile(t, `
+[[upstream]]
+host = "kibana.example.com"
+url = "http://127.0.0.1:5601/"
+
+[[upstream]]
+host = "grafana.example.com"
+path = "/api/"
+url = "http://127.0.0.1:3000/"
+`)
+	defer os.Remove(path)
+
+	o := testOptions()
+	// groups need encrypted cookies
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.VirtualHosts = []string{"host=grafana.example.com&upstream=http://127.0.0.1:3000/&group=ops"}
+	o.UpstreamsFile = path
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.upstreamConfigs))
+	// the kibana host gets a virtual host, the grafana one keeps its own
+	assert.Equal(t, 2, len(o.virtualHosts))
+	assert.Equal(t, "grafana.example.com", o.virtualHosts[0].Host)
+	assert.Equal(t, []string{"ops"}, o.virtualHosts[0].Rule.Groups)
+	assert.Equal(t, "kibana.example.com", o.virtualHosts[1].Host)
+
+	path = writeUpstreamsFile(t, "[[upstream]]\nhost = \"kibana.example.com\"")
+	defer os.Remove(path)
+	o = testOptions()
+	o.UpstreamsFile = path
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid upstreams-file "+path+": upstream 1: missing url")
+
+	// the --upstream already serves / for every host
+	path = writeUpstreamsFile(t, "[[upstream]]\nurl = \"http://127.0.0.1:3000/\"")
+	defer os.Remove(path)
+	o = testOptions()
+	o.UpstreamsFile = path
+	err = o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid upstreams-file "+path+": upstream 1: path \"/\" of host \"\" already has an upstream")
+
+	path = writeUpstreamsFile(t, `
+[[upstream]]
+host = "kibana.example.com"
+url = "http://127.0.0.1:5601/"
+
+[[upstream]]
+host = "Kibana.example.com"
+url = "http://127.0.0.1:5602/"
+`)
+	defer os.Remove(path)
+	o = testOptions()
+	o.UpstreamsFile = path
+	err = o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid upstreams-file "+path+": upstream 2: path \"/\" of host \"kibana.example.com\" already has an upstream")
+}
+
+func TestCookieSecretSizeWhenCookiesAreEncrypted(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "cookie secret"
+	assert.Equal(t, nil, o.Validate())
+
+	for _, configure := range []func(*Options){
+		func(o *Options) { o.AllowedGroups = []string{"ops"} },
+		func(o *Options) { o.AccessRules = []string{"path=^/admin/&group=ops"} },
+		func(o *Options) { o.VirtualHosts = []string{"host=a.example.com&upstream=http://127.0.0.1/&group=ops"} },
+		func(o *Options) { o.OIDCLogout = true },
+		func(o *Options) {
+			o.Provider = "keycloak"
+			o.KeycloakRealmURL = "https://sso.example.com/auth/realms/corp"
+			o.KeycloakRoles = []string{"admin"}
+		},
+	} {
+		o = testOptions()
+		o.CookieSecret = "cookie secret"
+		configure(o)
+		err := o.Validate()
+		if assert.NotEqual(t, nil, err) {
+			assert.Contains(t, err.Error(), "cookie_secret must be 16, 24, or 32 bytes")
+		}
+	}
+}
@@ -1,18 +1,33 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
 	"github.com/bitly/oauth2_proxy/api"
+	oidc "github.com/coreos/go-oidc"
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 type AzureProvider struct {
 	*ProviderData
 	Tenant string
+	// V2 uses the v2.0 endpoints, whose id_tokens are checked with Verifier,
+	// and reads the user's groups from Microsoft Graph
+	V2       bool
+	Verifier *oidc.IDTokenVerifier
+}
+
+// azureMultiTenants are the tenants that sign in users of any tenant, their
+// id_tokens are issued by the user's tenant
+var azureMultiTenants = map[string]bool{
+	"common":        true,
+	"organizations": true,
+	"consumers":     true,
 }
 
 func NewAzureProvider(p *ProviderData) *AzureProvider {
@@ -45,19 +60,212 @@ func (p *AzureProvider) Configure(tenant string) {
 		p.Tenant = "common"
 	}
 
+	endpoint := "/" + p.Tenant + "/oauth2/"
+	if p.V2 {
+		endpoint += "v2.0/"
+	}
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{
 			Scheme: "https",
 			Host:   "login.microsoftonline.com",
-			Path:   "/" + p.Tenant + "/oauth2/authorize"}
+			Path:   endpoint + "authorize"}
 	}
 	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
 		p.RedeemURL = &url.URL{
 			Scheme: "https",
 			Host:   "login.microsoftonline.com",
-			Path:   "/" + p.Tenant + "/oauth2/token",
+			Path:   endpoint + "token",
+		}
+	}
+}
+
+// ConfigureV2 is Configure for the v2.0 endpoints. The v1 defaults of the
+// profile URL, protected resource and scope are replaced by Microsoft Graph
+// and the scopes it needs.
+func (p *AzureProvider) ConfigureV2(tenant string) {
+	p.V2 = true
+	p.Configure(tenant)
+
+	if p.ProfileURL.Host == "graph.windows.net" {
+		p.ProfileURL = &url.URL{
+			Scheme: "https",
+			Host:   "graph.microsoft.com",
+			Path:   "/v1.0/me",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		validateURL := *p.ProfileURL
+		p.ValidateURL = &validateURL
+	}
+	// the v2.0 endpoints reject the resource parameter, the scopes name
+	// the resources instead
+	if p.ProtectedResource.Host == "graph.windows.net" {
+		p.ProtectedResource = &url.URL{}
+	}
+	if p.Scope == "openid" {
+		p.Scope = "openid email profile offline_access User.Read"
+	}
+
+	issuer := "https://login.microsoftonline.com/" + p.Tenant + "/v2.0"
+	keys := oidc.NewRemoteKeySet(context.Background(),
+		"https://login.microsoftonline.com/"+p.Tenant+"/discovery/v2.0/keys")
+	p.Verifier = oidc.NewVerifier(issuer, keys, &oidc.Config{
+		ClientID: p.ClientID,
+		// checked against the tid claim in updateSession
+		SkipIssuerCheck: azureMultiTenants[p.Tenant],
+	})
+}
+
+func (p *AzureProvider) Redeem(redirectURL, code, codeVerifier string) (*SessionState, error) {
+	if !p.V2 {
+		return p.ProviderData.Redeem(redirectURL, code, codeVerifier)
+	}
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	p.addClientCredentials(params)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+
+	s := &SessionState{}
+	if err := p.redeemToken(params, s); err != nil {
+		return nil, err
+	}
+	if err := p.updateSession(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RefreshSessionIfNeeded redeems the refresh token of v2.0 sessions once
+// the access token expired, and reads the user's groups from the new
+// id_token again
+func (p *AzureProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+	if !p.V2 || s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	params := url.Values{}
+	p.addClientCredentials(params)
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+	params.Add("scope", p.Scope)
+
+	origExpiration := s.ExpiresOn
+	idToken := s.IDToken
+	s.IDToken = ""
+	if err := p.redeemToken(params, s); err != nil {
+		s.IDToken = idToken
+		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+	}
+	// the id_token is optional in refresh responses, keep the one we have
+	if s.IDToken == "" {
+		s.IDToken = idToken
+	} else if err := p.updateSession(s); err != nil {
+		return false, err
+	}
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+func (p *AzureProvider) ValidateSessionState(s *SessionState) bool {
+	if !p.V2 {
+		return p.ProviderData.ValidateSessionState(s)
+	}
+	return validateToken(p, s.AccessToken, getAzureHeader(s.AccessToken))
+}
+
+// updateSession sets the user's email from the id_token and their groups,
+// which are read from Microsoft Graph when they didn't fit into the id_token
+func (p *AzureProvider) updateSession(s *SessionState) error {
+	idToken, err := p.Verifier.Verify(context.Background(), s.IDToken)
+	if err != nil {
+		return fmt.Errorf("could not verify id_token: %v", err)
+	}
+	var claims struct {
+		Email             string                 `json:"email"`
+		PreferredUsername string                 `json:"preferred_username"`
+		TenantID          string                 `json:"tid"`
+		Groups            []string               `json:"groups"`
+		ClaimNames        map[string]interface{} `json:"_claim_names"`
+		HasGroups         bool                   `json:"hasgroups"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
+	if azureMultiTenants[p.Tenant] &&
+		idToken.Issuer != "https://login.microsoftonline.com/"+claims.TenantID+"/v2.0" {
+		return fmt.Errorf("id_token issuer %q doesn't match its tenant %q", idToken.Issuer, claims.TenantID)
+	}
+
+	email := claims.Email
+	if email == "" {
+		// the user principal name, unless the email claim is configured
+		email = claims.PreferredUsername
+	}
+	if email == "" {
+		return errors.New("id_token did not contain an email")
+	}
+	if s.Email != "" && s.Email != email {
+		return fmt.Errorf("id_token email changed from %s to %s", s.Email, email)
+	}
+	s.Email = email
+	s.PreferredUsername = claims.PreferredUsername
+
+	// users in too many groups get the _claim_names or hasgroups overage
+	// claim instead of the groups
+	_, overage := claims.ClaimNames["groups"]
+	if overage || claims.HasGroups {
+		groups, err := p.getMemberOf(s.AccessToken)
+		if err != nil {
+			return fmt.Errorf("unable to read groups of %s: %v", email, err)
+		}
+		s.Groups = groups
+	} else {
+		s.Groups = claims.Groups
+	}
+	return nil
+}
+
+// getMemberOf returns the ids of the groups the user is a direct member of,
+// following the pages of https://docs.microsoft.com/en-us/graph/api/user-list-memberof
+func (p *AzureProvider) getMemberOf(access_token string) ([]string, error) {
+	endpoint := *p.ProfileURL
+	endpoint.Path += "/memberOf"
+	endpoint.RawQuery = url.Values{"$select": {"id"}}.Encode()
+
+	var groups []string
+	next := endpoint.String()
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = getAzureHeader(access_token)
+		var page struct {
+			Value []struct {
+				Type string `json:"@odata.type"`
+				ID   string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := api.RequestJson(req, &page); err != nil {
+			return nil, err
+		}
+		for _, member := range page.Value {
+			// directory roles are listed too
+			if member.Type == "#microsoft.graph.group" {
+				groups = append(groups, member.ID)
+			}
 		}
+		next = page.NextLink
 	}
+	return groups, nil
 }
 
 func getAzureHeader(access_token string) http.Header {
@@ -1,11 +1,15 @@
 package providers
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
+	oidc "github.com/coreos/go-oidc"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -199,3 +203,182 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+func TestAzureProviderV2Defaults(t *testing.T) {
+	p := testAzureProvider("")
+	p.ClientID = "bazquux"
+	p.ConfigureV2("example")
+	assert.Equal(t, true, p.V2)
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "",
+		p.Data().ProtectedResource.String())
+	assert.Equal(t, "openid email profile offline_access User.Read", p.Data().Scope)
+	assert.NotEqual(t, (*oidc.IDTokenVerifier)(nil), p.Verifier)
+}
+
+// testAzureGraph serves /v1.0/me and the groups of /v1.0/me/memberOf over
+// two pages
+func testAzureGraph() *httptest.Server {
+	var graph *httptest.Server
+	graph = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/v1.0/me":
+				w.Write([]byte(`{"mail": "michael.bland@gsa.gov"}`))
+			case "/v1.0/me/memberOf":
+				if r.URL.Query().Get("$skiptoken") == "" {
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"value": []map[string]string{
+							{"@odata.type": "#microsoft.graph.group", "id": "group-1"},
+							{"@odata.type": "#microsoft.graph.directoryRole", "id": "role-1"},
+						},
+						"@odata.nextLink": graph.URL + "/v1.0/me/memberOf?$skiptoken=page2",
+					})
+				} else {
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"value": []map[string]string{
+							{"@odata.type": "#microsoft.graph.group", "id": "group-2"},
+						},
+					})
+				}
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	return graph
+}
+
+func testAzureV2Provider(b *oidcTestBackend, graph *httptest.Server) *AzureProvider {
+	redeemURL, _ := url.Parse(b.URL + "/token")
+	profileURL, _ := url.Parse(graph.URL + "/v1.0/me")
+	p := NewAzureProvider(&ProviderData{
+		ClientID:          oidcClientID,
+		ClientSecret:      "xyzzyplugh",
+		LoginURL:          &url.URL{},
+		RedeemURL:         redeemURL,
+		ProfileURL:        profileURL,
+		ValidateURL:       &url.URL{},
+		ProtectedResource: &url.URL{},
+	})
+	p.ConfigureV2("example")
+	p.Verifier = oidc.NewVerifier(b.URL, oidc.NewRemoteKeySet(context.Background(), b.URL+"/keys"),
+		&oidc.Config{ClientID: oidcClientID})
+	return p
+}
+
+func TestAzureProviderV2Redeem(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	graph := testAzureGraph()
+	defer graph.Close()
+	p := testAzureV2Provider(b, graph)
+
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", b.tokenRequest.Get("resource"))
+	assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	assert.Equal(t, "mbland", s.PreferredUsername)
+	assert.Equal(t, []string{"admins", "users"}, s.Groups)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.NotEqual(t, "", s.IDToken)
+
+	// without the email claim the user principal name is used
+	delete(b.claims, "email")
+	b.claims["preferred_username"] = "mbland@gsa.onmicrosoft.com"
+	s, err = p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland@gsa.onmicrosoft.com", s.Email)
+}
+
+func TestAzureProviderV2RedeemGroupsOverage(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	graph := testAzureGraph()
+	defer graph.Close()
+	p := testAzureV2Provider(b, graph)
+
+	delete(b.claims, "groups")
+	b.claims["_claim_names"] = map[string]string{"groups": "src1"}
+	b.claims["_claim_sources"] = map[string]interface{}{
+		"src1": map[string]string{"endpoint": "https://graph.windows.net/example/users/123456789/getMemberObjects"},
+	}
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-1", "group-2"}, s.Groups)
+
+	delete(b.claims, "_claim_names")
+	delete(b.claims, "_claim_sources")
+	b.claims["hasgroups"] = true
+	s, err = p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-1", "group-2"}, s.Groups)
+}
+
+func TestAzureProviderV2MultiTenantIssuer(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	graph := testAzureGraph()
+	defer graph.Close()
+	p := testAzureV2Provider(b, graph)
+	p.Tenant = "common"
+
+	b.claims["tid"] = "example"
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, "id_token issuer \""+b.URL+"\" doesn't match its tenant \"example\"", err.Error())
+}
+
+func TestAzureProviderV2RefreshSessionIfNeeded(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	graph := testAzureGraph()
+	defer graph.Close()
+	p := testAzureV2Provider(b, graph)
+
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, nil, err)
+
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	b.claims["groups"] = []string{"admins"}
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refresh_token", b.tokenRequest.Get("grant_type"))
+	assert.Equal(t, "imaginary_refresh_token", b.tokenRequest.Get("refresh_token"))
+	assert.Equal(t, "refreshed_access_token", s.AccessToken)
+	assert.Equal(t, "refreshed_refresh_token", s.RefreshToken)
+	assert.Equal(t, []string{"admins"}, s.Groups)
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	b.rejectRefresh = true
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, false, refreshed)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestAzureProviderV2ValidateSessionState(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	graph := testAzureGraph()
+	defer graph.Close()
+	p := testAzureV2Provider(b, graph)
+
+	assert.Equal(t, true, p.ValidateSessionState(&SessionState{AccessToken: "imaginary_access_token"}))
+	assert.Equal(t, false, p.ValidateSessionState(&SessionState{AccessToken: "revoked"}))
+}
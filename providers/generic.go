@@ -0,0 +1,257 @@
+package providers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+// GenericProvider signs users in with any OAuth2 server, reading their
+// email, username and groups from the JSON of its userinfo endpoint, the
+// ProfileURL
+type GenericProvider struct {
+	*ProviderData
+	// UserinfoMethod is the HTTP method of userinfo requests
+	UserinfoMethod string
+	// AuthStyle is how userinfo requests pass the access token: "bearer" or
+	// "token" as that type of Authorization header, "query" as the
+	// access_token parameter
+	AuthStyle string
+	// EmailPath, UserPath and GroupsPath select the user's email, username
+	// and groups in the userinfo JSON, see jsonSelect. Without a UserPath or
+	// GroupsPath sessions don't get a username or groups.
+	EmailPath  string
+	UserPath   string
+	GroupsPath string
+}
+
+func NewGenericProvider(p *ProviderData) *GenericProvider {
+	p.ProviderName = "OAuth2"
+	return &GenericProvider{
+		ProviderData:   p,
+		UserinfoMethod: "GET",
+		AuthStyle:      "bearer",
+		EmailPath:      "email",
+	}
+}
+
+// SetUserinfoRequest sets the method and auth style of userinfo requests,
+// leaving the defaults when they're empty
+func (p *GenericProvider) SetUserinfoRequest(method, authStyle string) {
+	if method != "" {
+		p.UserinfoMethod = strings.ToUpper(method)
+	}
+	if authStyle != "" {
+		p.AuthStyle = strings.ToLower(authStyle)
+	}
+}
+
+// SetSelectors sets the selectors of the userinfo fields, leaving the email
+// selector's default when it's empty
+func (p *GenericProvider) SetSelectors(emailPath, userPath, groupsPath string) {
+	if emailPath != "" {
+		p.EmailPath = emailPath
+	}
+	p.UserPath = userPath
+	p.GroupsPath = groupsPath
+}
+
+func (p *GenericProvider) Redeem(redirectURL, code, codeVerifier string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	p.addClientCredentials(params)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+
+	s := &SessionState{}
+	if err := p.redeemToken(params, s); err != nil {
+		return nil, err
+	}
+	if err := p.updateSession(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RefreshSessionIfNeeded redeems the refresh token once the access token
+// expired, and reads the user's groups again
+func (p *GenericProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	params := url.Values{}
+	p.addClientCredentials(params)
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+
+	origExpiration := s.ExpiresOn
+	if err := p.redeemToken(params, s); err != nil {
+		return false, err
+	}
+	if err := p.updateSession(s); err != nil {
+		return false, err
+	}
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+func (p *GenericProvider) GetEmailAddress(s *SessionState) (string, error) {
+	userinfo, err := p.userinfo(s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return p.email(userinfo)
+}
+
+func (p *GenericProvider) GetUserName(s *SessionState) (string, error) {
+	// without a UserPath the username comes from the email
+	if p.UserPath == "" {
+		return "", errors.New("not implemented")
+	}
+	userinfo, err := p.userinfo(s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	user, _ := jsonSelect(userinfo, p.UserPath).(string)
+	if user == "" {
+		return "", fmt.Errorf("no username found at %q", p.UserPath)
+	}
+	return user, nil
+}
+
+func (p *GenericProvider) ValidateSessionState(s *SessionState) bool {
+	if s.AccessToken == "" {
+		return false
+	}
+	if _, err := p.userinfo(s.AccessToken); err != nil {
+		log.Printf("token validation request failed: %s", err)
+		return false
+	}
+	return true
+}
+
+// updateSession sets the user's email, username and groups from the
+// userinfo endpoint
+func (p *GenericProvider) updateSession(s *SessionState) error {
+	userinfo, err := p.userinfo(s.AccessToken)
+	if err != nil {
+		return err
+	}
+	email, err := p.email(userinfo)
+	if err != nil {
+		return err
+	}
+	if s.Email != "" && s.Email != email {
+		return fmt.Errorf("email changed from %s to %s", s.Email, email)
+	}
+	s.Email = email
+	if p.UserPath != "" {
+		s.User, _ = jsonSelect(userinfo, p.UserPath).(string)
+	}
+	if p.GroupsPath != "" {
+		s.Groups = claimStrings(jsonSelect(userinfo, p.GroupsPath))
+	}
+	return nil
+}
+
+func (p *GenericProvider) email(userinfo interface{}) (string, error) {
+	email, _ := jsonSelect(userinfo, p.EmailPath).(string)
+	if email == "" {
+		return "", fmt.Errorf("no email found at %q", p.EmailPath)
+	}
+	return email, nil
+}
+
+// userinfo requests the ProfileURL with the access token
+func (p *GenericProvider) userinfo(access_token string) (interface{}, error) {
+	endpoint := *p.ProfileURL
+	var body io.Reader
+	if p.AuthStyle == "query" {
+		if p.UserinfoMethod == "GET" {
+			params := endpoint.Query()
+			params.Set("access_token", access_token)
+			endpoint.RawQuery = params.Encode()
+		} else {
+			params := url.Values{"access_token": {access_token}}
+			body = bytes.NewBufferString(params.Encode())
+		}
+	}
+	req, err := http.NewRequest(p.UserinfoMethod, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	switch p.AuthStyle {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+access_token)
+	case "token":
+		req.Header.Set("Authorization", "token "+access_token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	var userinfo interface{}
+	if err := api.RequestJson(req, &userinfo); err != nil {
+		return nil, err
+	}
+	return userinfo, nil
+}
+
+// jsonSelect returns the value at a dot separated path in decoded JSON, ie:
+// "data.emails.0.value". A leading "$." is optional. Numbers index arrays,
+// "*" selects the rest of the path in each of their elements.
+func jsonSelect(v interface{}, path string) interface{} {
+	return selectPath(v, strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."))
+}
+
+func selectPath(v interface{}, path string) interface{} {
+	if path == "" {
+		return v
+	}
+	name, rest := path, ""
+	if i := strings.Index(path, "."); i != -1 {
+		name, rest = path[:i], path[i+1:]
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return selectPath(value[name], rest)
+	case []interface{}:
+		if name == "*" {
+			var all []interface{}
+			for _, element := range value {
+				switch selected := selectPath(element, rest).(type) {
+				case nil:
+				case []interface{}:
+					all = append(all, selected...)
+				default:
+					all = append(all, selected)
+				}
+			}
+			return all
+		}
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 || i >= len(value) {
+			return nil
+		}
+		return selectPath(value[i], rest)
+	}
+	return nil
+}
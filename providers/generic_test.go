@@ -0,0 +1,175 @@
+package providers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type genericTestBackend struct {
+	*httptest.Server
+	// the userinfo endpoint response
+	userinfo string
+	// form of the last token request, and the last userinfo request
+	tokenRequest    url.Values
+	userinfoRequest *http.Request
+}
+
+func newGenericTestBackend() *genericTestBackend {
+	b := &genericTestBackend{
+		userinfo: `{"data": {"login": "mbland",
+			"emails": [{"value": "michael.bland@gsa.gov"}],
+			"teams": [{"name": "admins"}, {"name": "ops"}]}}`,
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/oauth/token":
+			r.ParseForm()
+			b.tokenRequest = r.PostForm
+			access_token := "imaginary_access_token"
+			if r.PostForm.Get("grant_type") == "refresh_token" {
+				access_token = "refreshed_access_token"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  access_token,
+				"refresh_token": "imaginary_refresh_token",
+				"expires_in":    3600,
+			})
+		case "/api/me":
+			r.ParseForm()
+			b.userinfoRequest = r
+			token := r.Form.Get("access_token")
+			if token == "" {
+				token = r.Header.Get("Authorization")
+			}
+			switch token {
+			case "imaginary_access_token", "Bearer imaginary_access_token", "token imaginary_access_token",
+				"refreshed_access_token", "Bearer refreshed_access_token":
+				w.Write([]byte(b.userinfo))
+			default:
+				w.WriteHeader(401)
+			}
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return b
+}
+
+func testGenericProvider(b *genericTestBackend) *GenericProvider {
+	redeemURL, _ := url.Parse(b.URL + "/oauth/token")
+	profileURL, _ := url.Parse(b.URL + "/api/me")
+	p := NewGenericProvider(&ProviderData{
+		ClientID:     "bazquux",
+		ClientSecret: "xyzzyplugh",
+		LoginURL:     &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/oauth/authorize"},
+		RedeemURL:    redeemURL,
+		ProfileURL:   profileURL,
+		ValidateURL:  &url.URL{},
+	})
+	p.SetSelectors("$.data.emails.0.value", "data.login", "data.teams.*.name")
+	return p
+}
+
+func TestJSONSelect(t *testing.T) {
+	var v interface{}
+	json.Unmarshal([]byte(`{"email": "a@example.com", "nested": {"list": [
+		{"name": "first", "tags": ["x", "y"]}, {"name": "second", "tags": ["z"]}]}}`), &v)
+
+	assert.Equal(t, "a@example.com", jsonSelect(v, "email"))
+	assert.Equal(t, "a@example.com", jsonSelect(v, "$.email"))
+	assert.Equal(t, "second", jsonSelect(v, "nested.list.1.name"))
+	assert.Equal(t, []interface{}{"first", "second"}, jsonSelect(v, "nested.list.*.name"))
+	assert.Equal(t, []interface{}{"x", "y", "z"}, jsonSelect(v, "nested.list.*.tags"))
+	assert.Equal(t, nil, jsonSelect(v, "nested.list.2.name"))
+	assert.Equal(t, nil, jsonSelect(v, "email.missing"))
+	assert.Equal(t, nil, jsonSelect(v, "missing"))
+}
+
+func TestGenericProviderRedeem(t *testing.T) {
+	b := newGenericTestBackend()
+	defer b.Close()
+	p := testGenericProvider(b)
+
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "authorization_code", b.tokenRequest.Get("grant_type"))
+	assert.Equal(t, "code1234", b.tokenRequest.Get("code"))
+	assert.Equal(t, "GET", b.userinfoRequest.Method)
+	assert.Equal(t, "Bearer imaginary_access_token", b.userinfoRequest.Header.Get("Authorization"))
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	assert.Equal(t, "mbland", s.User)
+	assert.Equal(t, []string{"admins", "ops"}, s.Groups)
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+}
+
+func TestGenericProviderRedeemWithoutEmail(t *testing.T) {
+	b := newGenericTestBackend()
+	defer b.Close()
+	p := testGenericProvider(b)
+	p.SetSelectors("data.email", "", "")
+
+	_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, `no email found at "data.email"`, err.Error())
+}
+
+func TestGenericProviderUserinfoRequest(t *testing.T) {
+	b := newGenericTestBackend()
+	defer b.Close()
+	p := testGenericProvider(b)
+	s := &SessionState{AccessToken: "imaginary_access_token"}
+
+	p.SetUserinfoRequest("post", "query")
+	email, err := p.GetEmailAddress(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, "POST", b.userinfoRequest.Method)
+	assert.Equal(t, "", b.userinfoRequest.Header.Get("Authorization"))
+	assert.Equal(t, "imaginary_access_token", b.userinfoRequest.PostForm.Get("access_token"))
+
+	p.SetUserinfoRequest("GET", "query")
+	user, err := p.GetUserName(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+	assert.Equal(t, "imaginary_access_token", b.userinfoRequest.URL.Query().Get("access_token"))
+
+	p.SetUserinfoRequest("", "token")
+	assert.Equal(t, true, p.ValidateSessionState(s))
+	assert.Equal(t, "token imaginary_access_token", b.userinfoRequest.Header.Get("Authorization"))
+	assert.Equal(t, false, p.ValidateSessionState(&SessionState{AccessToken: "revoked"}))
+}
+
+func TestGenericProviderRefreshSessionIfNeeded(t *testing.T) {
+	b := newGenericTestBackend()
+	defer b.Close()
+	p := testGenericProvider(b)
+
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, nil, err)
+
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	b.userinfo = `{"data": {"login": "mbland", "emails": [{"value": "michael.bland@gsa.gov"}], "teams": []}}`
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refresh_token", b.tokenRequest.Get("grant_type"))
+	assert.Equal(t, "refreshed_access_token", s.AccessToken)
+	assert.Equal(t, []string(nil), s.Groups)
+
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	b.userinfo = `{"data": {"emails": [{"value": "someone.else@gsa.gov"}]}}`
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "email changed from michael.bland@gsa.gov to someone.else@gsa.gov", err.Error())
+}
@@ -16,6 +16,10 @@ type GitHubProvider struct {
 	*ProviderData
 	Org  string
 	Team string
+	// Repo restricts logins to collaborators of the "owner/repo" repository
+	Repo string
+	// Users are logins allowed to sign in without the other restrictions
+	Users []string
 }
 
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
@@ -47,6 +51,25 @@ func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 	}
 	return &GitHubProvider{ProviderData: p}
 }
+
+// Configure moves the endpoints still pointing at github.com to the GitHub
+// Enterprise server at baseURL, ie: https://github.example.com
+func (p *GitHubProvider) Configure(baseURL *url.URL) {
+	basePath := strings.TrimSuffix(baseURL.Path, "/")
+	for _, u := range []*url.URL{p.LoginURL, p.RedeemURL} {
+		if u.Host == "github.com" {
+			u.Scheme = baseURL.Scheme
+			u.Host = baseURL.Host
+			u.Path = basePath + u.Path
+		}
+	}
+	if p.ValidateURL.Host == "api.github.com" {
+		p.ValidateURL.Scheme = baseURL.Scheme
+		p.ValidateURL.Host = baseURL.Host
+		p.ValidateURL.Path = basePath + "/api/v3/"
+	}
+}
+
 func (p *GitHubProvider) SetOrgTeam(org, team string) {
 	p.Org = org
 	p.Team = team
@@ -55,6 +78,17 @@ func (p *GitHubProvider) SetOrgTeam(org, team string) {
 	}
 }
 
+// SetRepo restricts logins to collaborators of the repository. Private
+// repositories aren't visible without the repo scope, which isn't requested
+// here as it grants access to all of the user's private repositories.
+func (p *GitHubProvider) SetRepo(repo string) {
+	p.Repo = repo
+}
+
+func (p *GitHubProvider) SetUsers(users []string) {
+	p.Users = users
+}
+
 func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 	// https://developer.github.com/v3/orgs/#list-your-organizations
 
@@ -125,7 +159,7 @@ func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	// https://developer.github.com/v3/orgs/teams/#list-user-teams
 
-	var teams []struct {
+	type teamsPage []struct {
 		Name string `json:"name"`
 		Slug string `json:"slug"`
 		Org  struct {
@@ -133,36 +167,48 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 		} `json:"organization"`
 	}
 
-	params := url.Values{
-		"limit": {"200"},
-	}
+	var teams teamsPage
+	pn := 1
+	for {
+		params := url.Values{
+			"per_page": {"100"},
+			"page":     {strconv.Itoa(pn)},
+		}
 
-	endpoint := &url.URL{
-		Scheme:   p.ValidateURL.Scheme,
-		Host:     p.ValidateURL.Host,
-		Path:     path.Join(p.ValidateURL.Path, "/user/teams"),
-		RawQuery: params.Encode(),
-	}
-	req, _ := http.NewRequest("GET", endpoint.String(), nil)
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false, err
-	}
+		endpoint := &url.URL{
+			Scheme:   p.ValidateURL.Scheme,
+			Host:     p.ValidateURL.Host,
+			Path:     path.Join(p.ValidateURL.Path, "/user/teams"),
+			RawQuery: params.Encode(),
+		}
+		req, _ := http.NewRequest("GET", endpoint.String(), nil)
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, err
+		}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return false, err
-	}
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf(
-			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
-	}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode != 200 {
+			return false, fmt.Errorf(
+				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+		}
 
-	if err := json.Unmarshal(body, &teams); err != nil {
-		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		var tp teamsPage
+		if err := json.Unmarshal(body, &tp); err != nil {
+			return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		}
+		if len(tp) == 0 {
+			break
+		}
+
+		teams = append(teams, tp...)
+		pn += 1
 	}
 
 	var hasOrg bool
@@ -194,25 +240,110 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	return false, nil
 }
 
-func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *GitHubProvider) hasRepo(accessToken string) (bool, error) {
+	// https://developer.github.com/v3/repos/#get
 
-	var emails []struct {
-		Email   string `json:"email"`
-		Primary bool   `json:"primary"`
+	var repo struct {
+		Private     bool `json:"private"`
+		Permissions struct {
+			Pull bool `json:"pull"`
+			Push bool `json:"push"`
+		} `json:"permissions"`
+	}
+
+	endpoint := &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, "/repos/", p.Repo),
+	}
+	req, _ := http.NewRequest("GET", endpoint.String(), nil)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == 404 {
+		// a private repository the user can't see, or the token lacks the
+		// repo scope
+		log.Printf("Missing Repository:%q", p.Repo)
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+
+	if err := json.Unmarshal(body, &repo); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+
+	// every user can pull from a public repository, its collaborators are
+	// the ones who can push to it
+	if repo.Permissions.Push || (repo.Private && repo.Permissions.Pull) {
+		log.Printf("Found Github Repository:%q", p.Repo)
+		return true, nil
+	}
+	log.Printf("Missing collaborator access to Repository:%q", p.Repo)
+	return false, nil
+}
+
+// isAllowed checks the user is one of the Users, or passes the Org, Team and
+// Repo restrictions
+func (p *GitHubProvider) isAllowed(accessToken string) (bool, error) {
+	if len(p.Users) != 0 {
+		login, err := p.getLogin(accessToken)
+		if err != nil {
+			return false, err
+		}
+		for _, user := range p.Users {
+			if strings.EqualFold(user, login) {
+				log.Printf("Found Github User:%q", login)
+				return true, nil
+			}
+		}
+		if p.Org == "" && p.Repo == "" {
+			log.Printf("Missing User:%q in %v", login, p.Users)
+			return false, nil
+		}
 	}
 
-	// if we require an Org or Team, check that first
 	if p.Org != "" {
 		if p.Team != "" {
-			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
-				return "", err
+			if ok, err := p.hasOrgAndTeam(accessToken); err != nil || !ok {
+				return false, err
 			}
 		} else {
-			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
-				return "", err
+			if ok, err := p.hasOrg(accessToken); err != nil || !ok {
+				return false, err
 			}
 		}
 	}
+	if p.Repo != "" {
+		if ok, err := p.hasRepo(accessToken); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
+
+	var emails []struct {
+		Email   string `json:"email"`
+		Primary bool   `json:"primary"`
+	}
+
+	// if we require a User, Org, Team or Repo, check that first
+	if ok, err := p.isAllowed(s.AccessToken); err != nil || !ok {
+		return "", err
+	}
 
 	endpoint := &url.URL{
 		Scheme: p.ValidateURL.Scheme,
@@ -252,6 +383,10 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 }
 
 func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
+	return p.getLogin(s.AccessToken)
+}
+
+func (p *GitHubProvider) getLogin(accessToken string) (string, error) {
 	var user struct {
 		Login string `json:"login"`
 		Email string `json:"email"`
@@ -268,7 +403,7 @@ func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
 		return "", fmt.Errorf("could not create new GET request: %v", err)
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", s.AccessToken))
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
@@ -171,3 +171,118 @@ func TestGitHubProviderGetUserName(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "mbland", email)
 }
+
+// testGitHubAPI serves the JSON of responses by request URI, and 404 for
+// the others
+func testGitHubAPI(responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, ok := responses[r.URL.RequestURI()]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(body))
+		}))
+}
+
+func TestGitHubProviderConfigure(t *testing.T) {
+	p := testGitHubProvider("")
+	baseURL, _ := url.Parse("https://github.example.com/")
+	p.Configure(baseURL)
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://github.example.com/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3/",
+		p.Data().ValidateURL.String())
+}
+
+func TestGitHubProviderGetEmailAddressWithTeamOnLaterPage(t *testing.T) {
+	b := testGitHubAPI(map[string]string{
+		"/user/teams?page=1&per_page=100": `[ {"slug": "other", "organization": {"login": "testorg"}} ]`,
+		"/user/teams?page=2&per_page=100": `[ {"slug": "testteam", "organization": {"login": "testorg"}} ]`,
+		"/user/teams?page=3&per_page=100": `[]`,
+		"/user/emails":                    `[ {"email": "michael.bland@gsa.gov", "primary": true} ]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetOrgTeam("testorg", "testteam")
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.SetOrgTeam("testorg", "missingteam")
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGitHubProviderGetEmailAddressWithRepo(t *testing.T) {
+	responses := map[string]string{
+		"/repos/testorg/public":  `{"private": false, "permissions": {"pull": true, "push": true}}`,
+		"/repos/testorg/readme":  `{"private": false, "permissions": {"pull": true, "push": false}}`,
+		"/repos/testorg/private": `{"private": true, "permissions": {"pull": true, "push": false}}`,
+		"/user/emails":           `[ {"email": "michael.bland@gsa.gov", "primary": true} ]`,
+	}
+	b := testGitHubAPI(responses)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+
+	for repo, allowed := range map[string]bool{
+		"testorg/public":  true,
+		"testorg/readme":  false,
+		"testorg/private": true,
+		"testorg/missing": false,
+	} {
+		p.Repo = repo
+		email, err := p.GetEmailAddress(session)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, allowed, email != "", repo)
+	}
+}
+
+func TestGitHubProviderGetEmailAddressWithUsers(t *testing.T) {
+	b := testGitHubAPI(map[string]string{
+		"/user":                       `{"login": "mbland"}`,
+		"/user/orgs?limit=200&page=1": `[]`,
+		"/user/emails":                `[ {"email": "michael.bland@gsa.gov", "primary": true} ]`,
+		"/repos/testorg/testrepo":     `{"private": true, "permissions": {"pull": true}}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+
+	p.SetUsers([]string{"MBland"})
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.SetUsers([]string{"someone"})
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+
+	// users not in the list still sign in with the other restrictions
+	p.SetOrgTeam("testorg", "")
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+
+	p.SetOrgTeam("", "")
+	p.SetRepo("testorg/testrepo")
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, "user:email read:org", p.Scope)
+}
@@ -1,15 +1,65 @@
 package providers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/bitly/go-simplejson"
 	"github.com/bitly/oauth2_proxy/api"
 )
 
 type GitLabProvider struct {
 	*ProviderData
+	// Groups and Projects restrict logins to members of one of the groups
+	// or one of the projects
+	Groups   []string
+	Projects []GitLabProject
+}
+
+// GitLabProject is a project given by its path, ie: "group/subgroup/project",
+// and the minimum access level its members need to sign in
+type GitLabProject struct {
+	Path        string
+	AccessLevel int
+}
+
+// gitLabAccessLevels are the member access levels of the GitLab API
+var gitLabAccessLevels = map[string]int{
+	"guest":      10,
+	"reporter":   20,
+	"developer":  30,
+	"maintainer": 40,
+	"owner":      50,
+}
+
+// ParseGitLabProject parses "<path>[=<access level>]", where the access
+// level is a number or its name (guest, reporter, developer, maintainer,
+// owner). Reporter access is required by default.
+func ParseGitLabProject(spec string) (GitLabProject, error) {
+	project := GitLabProject{Path: spec, AccessLevel: gitLabAccessLevels["reporter"]}
+	if i := strings.LastIndex(spec, "="); i != -1 {
+		project.Path = spec[:i]
+		level := strings.ToLower(spec[i+1:])
+		if named, ok := gitLabAccessLevels[level]; ok {
+			project.AccessLevel = named
+		} else if n, err := strconv.Atoi(level); err == nil && n > 0 {
+			project.AccessLevel = n
+		} else {
+			return project, fmt.Errorf("invalid access level %q", spec[i+1:])
+		}
+	}
+	project.Path = strings.Trim(project.Path, "/")
+	if project.Path == "" {
+		return project, errors.New("missing project path")
+	}
+	return project, nil
 }
 
 func NewGitLabProvider(p *ProviderData) *GitLabProvider {
@@ -41,6 +91,37 @@ func NewGitLabProvider(p *ProviderData) *GitLabProvider {
 	return &GitLabProvider{ProviderData: p}
 }
 
+// Configure moves the endpoints still pointing at gitlab.com to the
+// self-hosted GitLab at baseURL, ie: https://gitlab.example.com
+func (p *GitLabProvider) Configure(baseURL *url.URL) {
+	for _, u := range []*url.URL{p.LoginURL, p.RedeemURL, p.ValidateURL} {
+		if u.Host == "gitlab.com" {
+			u.Scheme = baseURL.Scheme
+			u.Host = baseURL.Host
+			u.Path = strings.TrimSuffix(baseURL.Path, "/") + u.Path
+		}
+	}
+}
+
+func (p *GitLabProvider) SetGroupsProjects(groups []string, projects []GitLabProject) {
+	p.Groups = groups
+	p.Projects = projects
+	if len(groups) != 0 || len(projects) != 0 {
+		// the group and project APIs aren't available with read_user
+		p.Scope += " read_api"
+	}
+}
+
+// apiURL returns the URL of an API endpoint next to the ValidateURL, which
+// is the API's /user endpoint
+func (p *GitLabProvider) apiURL(endpoint string) string {
+	u := *p.ValidateURL
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/user")
+	u.RawPath = ""
+	return u.String() + endpoint
+}
+
 func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	req, err := http.NewRequest("GET",
@@ -54,5 +135,146 @@ func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
 		log.Printf("failed making request %s", err)
 		return "", err
 	}
-	return json.Get("email").String()
+	email, err := json.Get("email").String()
+	if err != nil {
+		return "", err
+	}
+	if err := p.checkMembership(s.AccessToken, json); err != nil {
+		return "", fmt.Errorf("%s %s", email, err)
+	}
+	return email, nil
+}
+
+// ValidateSessionState checks the access token and that the user is still a
+// member of the groups or projects
+func (p *GitLabProvider) ValidateSessionState(s *SessionState) bool {
+	if len(p.Groups) == 0 && len(p.Projects) == 0 {
+		return validateToken(p, s.AccessToken, nil)
+	}
+	// fails unless the access token is valid
+	req, err := http.NewRequest("GET", p.ValidateURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	req.Header = getGitLabHeader(s.AccessToken)
+	json, err := api.Request(req)
+	if err != nil {
+		log.Printf("token validation request failed: %s", err)
+		return false
+	}
+	if err := p.checkMembership(s.AccessToken, json); err != nil {
+		log.Printf("%s %s", s, err)
+		return false
+	}
+	return true
+}
+
+// checkMembership returns an error unless user is a member of one of the
+// groups, including inherited membership of subgroups, or has the required
+// access to one of the projects
+func (p *GitLabProvider) checkMembership(accessToken string, user *simplejson.Json) error {
+	if len(p.Groups) == 0 && len(p.Projects) == 0 {
+		return nil
+	}
+	userID, err := user.Get("id").Int()
+	if err != nil {
+		return err
+	}
+	for _, group := range p.Groups {
+		ok, err := p.isGroupMember(accessToken, group, userID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	for _, project := range p.Projects {
+		ok, err := p.hasProjectAccess(accessToken, project)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.New("is not a member of the allowed gitlab groups or projects")
+}
+
+func (p *GitLabProvider) isGroupMember(accessToken, group string, userID int) (bool, error) {
+	// https://docs.gitlab.com/ee/api/members.html#get-a-member-of-a-group-or-project-including-inherited-members
+	endpoint := p.apiURL(fmt.Sprintf("/groups/%s/members/all/%d",
+		url.PathEscape(strings.Trim(group, "/")), userID))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header = getGitLabHeader(accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	log.Printf("%d GET %s", resp.StatusCode, endpoint)
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		// not a member, or a private group the user can't see
+		return false, nil
+	}
+	return false, fmt.Errorf("got %d from %q", resp.StatusCode, endpoint)
+}
+
+func (p *GitLabProvider) hasProjectAccess(accessToken string, project GitLabProject) (bool, error) {
+	// https://docs.gitlab.com/ee/api/projects.html#get-single-project
+	endpoint := p.apiURL("/projects/" + url.PathEscape(project.Path))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header = getGitLabHeader(accessToken)
+	var data struct {
+		Permissions struct {
+			ProjectAccess *struct {
+				AccessLevel int `json:"access_level"`
+			} `json:"project_access"`
+			GroupAccess *struct {
+				AccessLevel int `json:"access_level"`
+			} `json:"group_access"`
+		} `json:"permissions"`
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	log.Printf("%d GET %s", resp.StatusCode, endpoint)
+	if resp.StatusCode == 404 {
+		// not a member of a private project
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if a := data.Permissions.ProjectAccess; a != nil && a.AccessLevel >= project.AccessLevel {
+		return true, nil
+	}
+	if a := data.Permissions.GroupAccess; a != nil && a.AccessLevel >= project.AccessLevel {
+		return true, nil
+	}
+	return false, nil
+}
+
+func getGitLabHeader(access_token string) http.Header {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
+	return header
 }
@@ -126,3 +126,91 @@ func TestGitLabProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+func TestGitLabProviderConfigureBaseURL(t *testing.T) {
+	p := testGitLabProvider("")
+	baseURL, _ := url.Parse("https://gitlab.example.com/gitlab/")
+	p.Configure(baseURL)
+	assert.Equal(t, "https://gitlab.example.com/gitlab/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://gitlab.example.com/gitlab/oauth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://gitlab.example.com/gitlab/api/v4/user",
+		p.Data().ValidateURL.String())
+}
+
+func TestParseGitLabProject(t *testing.T) {
+	project, err := ParseGitLabProject("group/subgroup/project")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, GitLabProject{"group/subgroup/project", 20}, project)
+
+	project, err = ParseGitLabProject("group/project=Developer")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, GitLabProject{"group/project", 30}, project)
+
+	project, err = ParseGitLabProject("group/project=40")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, GitLabProject{"group/project", 40}, project)
+
+	_, err = ParseGitLabProject("group/project=admin")
+	assert.Equal(t, "invalid access level \"admin\"", err.Error())
+	_, err = ParseGitLabProject("=30")
+	assert.Equal(t, "missing project path", err.Error())
+}
+
+// testGitLabMembershipBackend has user 42 in the "group/subgroup" group and
+// the "group/project" project with developer access
+func testGitLabMembershipBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" &&
+				r.URL.Query().Get("access_token") != "imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			switch r.URL.EscapedPath() {
+			case "/api/v4/user":
+				w.Write([]byte(`{"id": 42, "email": "michael.bland@gsa.gov"}`))
+			case "/api/v4/groups/group%2Fsubgroup/members/all/42":
+				w.Write([]byte(`{"id": 42, "access_level": 10}`))
+			case "/api/v4/projects/group%2Fproject":
+				w.Write([]byte(`{"permissions": {"project_access": null, "group_access": {"access_level": 30}}}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestGitLabProviderGroupsAndProjects(t *testing.T) {
+	b := testGitLabMembershipBackend()
+	defer b.Close()
+	b_url, _ := url.Parse(b.URL)
+
+	for _, restriction := range []struct {
+		groups   []string
+		projects []GitLabProject
+		ok       bool
+	}{
+		{[]string{"group/subgroup"}, nil, true},
+		{[]string{"other", "/group/subgroup/"}, nil, true},
+		{[]string{"group"}, nil, false},
+		{nil, []GitLabProject{{"group/project", 30}}, true},
+		{nil, []GitLabProject{{"group/project", 40}}, false},
+		{nil, []GitLabProject{{"group/private", 10}}, false},
+		{[]string{"group"}, []GitLabProject{{"group/project", 20}}, true},
+	} {
+		p := testGitLabProvider(b_url.Host)
+		p.SetGroupsProjects(restriction.groups, restriction.projects)
+		assert.Equal(t, "read_user read_api", p.Data().Scope)
+
+		session := &SessionState{AccessToken: "imaginary_access_token"}
+		email, err := p.GetEmailAddress(session)
+		if restriction.ok {
+			assert.Equal(t, nil, err)
+			assert.Equal(t, "michael.bland@gsa.gov", email)
+		} else {
+			assert.Equal(t, "michael.bland@gsa.gov is not a member of the allowed gitlab groups or projects", err.Error())
+		}
+		assert.Equal(t, restriction.ok, p.ValidateSessionState(session))
+	}
+}
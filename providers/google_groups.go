@@ -0,0 +1,234 @@
+package providers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// GoogleGroupCache remembers whether users are members of the groups, so
+// validating a session doesn't call the Admin Directory API. A user's
+// membership is looked up on first use and then kept up to date in the
+// background for as long as it keeps being asked for.
+type GoogleGroupCache struct {
+	service *admin.Service
+	groups  []string
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*googleGroupCacheEntry
+
+	// closing done stops the background refresh, which closes stopped
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type googleGroupCacheEntry struct {
+	member  bool
+	checked time.Time
+	// used is set when the entry is asked for, entries that weren't used
+	// since the last refresh are dropped
+	used bool
+}
+
+// NewGoogleGroupCache returns a cache of the membership of the groups that
+// refreshes its entries every ttl. Without a ttl nothing is cached.
+func NewGoogleGroupCache(service *admin.Service, groups []string, ttl time.Duration) *GoogleGroupCache {
+	c := &GoogleGroupCache{
+		service: service,
+		groups:  groups,
+		ttl:     ttl,
+		entries: make(map[string]*googleGroupCacheEntry),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if ttl > 0 {
+		go c.run()
+	} else {
+		close(c.stopped)
+	}
+	return c
+}
+
+// Stop ends the background refresh of the cache
+func (c *GoogleGroupCache) Stop() {
+	close(c.done)
+	<-c.stopped
+}
+
+// IsMember returns whether the user with email is a member of one of the
+// groups, looking the membership up unless it's cached
+func (c *GoogleGroupCache) IsMember(email string) bool {
+	if c.ttl > 0 {
+		c.mu.Lock()
+		e, ok := c.entries[email]
+		if ok && time.Since(e.checked) < c.ttl {
+			e.used = true
+			c.mu.Unlock()
+			return e.member
+		}
+		c.mu.Unlock()
+	}
+
+	member, err := userInGroup(c.service, c.groups, email)
+	if err != nil {
+		log.Printf("error checking google group membership of %s: %v", email, err)
+		return false
+	}
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.entries[email] = &googleGroupCacheEntry{member: member, checked: time.Now(), used: true}
+		c.mu.Unlock()
+	}
+	return member
+}
+
+func (c *GoogleGroupCache) run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// refresh looks the memberships that were used since the last refresh up
+// again, and drops the others. Memberships that can't be looked up keep
+// their previous value until they expire.
+func (c *GoogleGroupCache) refresh() {
+	c.mu.Lock()
+	var emails []string
+	for email, e := range c.entries {
+		if e.used {
+			emails = append(emails, email)
+			e.used = false
+		} else {
+			delete(c.entries, email)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, email := range emails {
+		member, err := userInGroup(c.service, c.groups, email)
+		if err != nil {
+			log.Printf("error refreshing google group membership of %s: %v", email, err)
+			continue
+		}
+		c.mu.Lock()
+		c.entries[email] = &googleGroupCacheEntry{member: member, checked: time.Now()}
+		c.mu.Unlock()
+	}
+}
+
+// userInGroup checks whether the user is a direct or nested member of one
+// of the groups
+func userInGroup(service *admin.Service, groups []string, email string) (bool, error) {
+	var user *admin.User
+	for _, group := range groups {
+		// https://developers.google.com/admin-sdk/directory/v1/reference/members/hasMember
+		r, err := service.Members.HasMember(group, email).Do()
+		if err == nil {
+			if r.IsMember {
+				return true, nil
+			}
+			continue
+		}
+		apiErr, ok := err.(*googleapi.Error)
+		if ok && apiErr.Code == 404 {
+			log.Printf("error checking members of group %s: group does not exist", group)
+			continue
+		} else if !ok || apiErr.Code != 400 {
+			return false, err
+		}
+
+		// hasMember can't check groups with members outside the domain or
+		// the whole customer as a member, go through the members instead
+		if user == nil {
+			if user, err = fetchUser(service, email); err != nil {
+				return false, err
+			}
+		}
+		member, err := groupHasMember(service, group, user, make(map[string]bool))
+		if err != nil {
+			return false, err
+		}
+		if member {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// groupHasMember looks for the user in the members of group and of the
+// groups within it. visited holds the groups already looked at.
+func groupHasMember(service *admin.Service, group string, user *admin.User, visited map[string]bool) (bool, error) {
+	visited[group] = true
+	members, err := fetchGroupMembers(service, group)
+	if err != nil {
+		if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
+			log.Printf("error fetching members for group %s: group does not exist", group)
+			return false, nil
+		}
+		return false, err
+	}
+
+	var nested []string
+	for _, member := range members {
+		switch member.Type {
+		case "CUSTOMER":
+			if member.Id == user.CustomerId {
+				return true, nil
+			}
+		case "USER":
+			if member.Id == user.Id {
+				return true, nil
+			}
+		case "GROUP":
+			if !visited[member.Email] {
+				nested = append(nested, member.Email)
+			}
+		}
+	}
+	for _, group := range nested {
+		if member, err := groupHasMember(service, group, user, visited); err != nil || member {
+			return member, err
+		}
+	}
+	return false, nil
+}
+
+func fetchUser(service *admin.Service, email string) (*admin.User, error) {
+	user, err := service.Users.Get(email).Do()
+	return user, err
+}
+
+func fetchGroupMembers(service *admin.Service, group string) ([]*admin.Member, error) {
+	members := []*admin.Member{}
+	pageToken := ""
+	for {
+		req := service.Members.List(group)
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		r, err := req.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range r.Members {
+			members = append(members, member)
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+	return members, nil
+}
@@ -0,0 +1,179 @@
+package providers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/admin/directory/v1"
+)
+
+type adminDirectoryTest struct {
+	backend *httptest.Server
+	service *admin.Service
+	// responses by request path, other paths get a 404
+	responses map[string]interface{}
+	requests  int
+}
+
+func newAdminDirectoryTest() *adminDirectoryTest {
+	at := &adminDirectoryTest{responses: make(map[string]interface{})}
+	at.backend = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			at.requests++
+			key := r.URL.Path
+			if token := r.URL.Query().Get("pageToken"); token != "" {
+				key += "?pageToken=" + token
+			}
+			response, ok := at.responses[key]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			if code, ok := response.(int); ok {
+				w.WriteHeader(code)
+				return
+			}
+			json.NewEncoder(w).Encode(response)
+		}))
+	at.service, _ = admin.New(http.DefaultClient)
+	at.service.BasePath = at.backend.URL + "/"
+	return at
+}
+
+func (at *adminDirectoryTest) Close() {
+	at.backend.Close()
+}
+
+func TestGoogleUserInGroupHasMember(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	at.responses["/groups/admins@example.com/hasMember/michael.bland@gsa.gov"] = map[string]bool{"isMember": false}
+	at.responses["/groups/users@example.com/hasMember/michael.bland@gsa.gov"] = map[string]bool{"isMember": true}
+
+	member, err := userInGroup(at.service, []string{"admins@example.com"}, "michael.bland@gsa.gov")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, member)
+
+	// groups that don't exist are skipped
+	member, err = userInGroup(at.service, []string{"missing@example.com", "users@example.com"}, "michael.bland@gsa.gov")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, member)
+}
+
+func TestGoogleUserInGroupNestedMembers(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	// hasMember can't check groups with external members
+	at.responses["/groups/all@example.com/hasMember/michael.bland@gsa.gov"] = 400
+	at.responses["/users/michael.bland@gsa.gov"] = admin.User{Id: "123", CustomerId: "C01"}
+	at.responses["/groups/all@example.com/members"] = admin.Members{
+		Members: []*admin.Member{
+			{Type: "USER", Id: "456"},
+			{Type: "GROUP", Email: "all@example.com"},
+		},
+		NextPageToken: "page2",
+	}
+	at.responses["/groups/all@example.com/members?pageToken=page2"] = admin.Members{
+		Members: []*admin.Member{{Type: "GROUP", Email: "staff@example.com"}},
+	}
+	at.responses["/groups/staff@example.com/members"] = admin.Members{
+		Members: []*admin.Member{{Type: "USER", Id: "123"}},
+	}
+
+	member, err := userInGroup(at.service, []string{"all@example.com"}, "michael.bland@gsa.gov")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, member)
+
+	at.responses["/groups/staff@example.com/members"] = admin.Members{
+		Members: []*admin.Member{{Type: "CUSTOMER", Id: "C02"}},
+	}
+	member, err = userInGroup(at.service, []string{"all@example.com"}, "michael.bland@gsa.gov")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, member)
+}
+
+func TestGoogleUserInGroupError(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	at.responses["/groups/admins@example.com/hasMember/michael.bland@gsa.gov"] = 403
+
+	member, err := userInGroup(at.service, []string{"admins@example.com"}, "michael.bland@gsa.gov")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, member)
+}
+
+func TestGoogleGroupCache(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	hasMember := "/groups/admins@example.com/hasMember/michael.bland@gsa.gov"
+	at.responses[hasMember] = map[string]bool{"isMember": true}
+	// the background refresh doesn't run within the test
+	c := NewGoogleGroupCache(at.service, []string{"admins@example.com"}, time.Hour)
+	defer c.Stop()
+
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	assert.Equal(t, 1, at.requests)
+
+	// refreshing looks up the memberships in use again
+	at.responses[hasMember] = map[string]bool{"isMember": false}
+	c.refresh()
+	assert.Equal(t, 2, at.requests)
+	assert.Equal(t, false, c.IsMember("michael.bland@gsa.gov"))
+	assert.Equal(t, 2, at.requests)
+
+	// failed lookups keep the previous membership
+	at.responses[hasMember] = 500
+	c.refresh()
+	assert.Equal(t, 3, at.requests)
+	assert.Equal(t, false, c.IsMember("michael.bland@gsa.gov"))
+
+	// unused memberships are dropped
+	c.refresh()
+	c.refresh()
+	assert.Equal(t, 0, len(c.entries))
+}
+
+func TestGoogleGroupCacheExpires(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	at.responses["/groups/admins@example.com/hasMember/michael.bland@gsa.gov"] = map[string]bool{"isMember": true}
+	c := NewGoogleGroupCache(at.service, []string{"admins@example.com"}, time.Hour)
+	defer c.Stop()
+
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	c.entries["michael.bland@gsa.gov"].checked = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	assert.Equal(t, 2, at.requests)
+}
+
+func TestGoogleGroupCacheDisabled(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	at.responses["/groups/admins@example.com/hasMember/michael.bland@gsa.gov"] = map[string]bool{"isMember": true}
+	c := NewGoogleGroupCache(at.service, []string{"admins@example.com"}, 0)
+	defer c.Stop()
+
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	assert.Equal(t, 2, at.requests)
+	assert.Equal(t, false, c.IsMember("someone@gsa.gov"))
+	assert.Equal(t, 0, len(c.entries))
+}
+
+func TestGoogleGroupCacheStop(t *testing.T) {
+	at := newAdminDirectoryTest()
+	defer at.Close()
+	at.responses["/groups/admins@example.com/hasMember/michael.bland@gsa.gov"] = map[string]bool{"isMember": true}
+	c := NewGoogleGroupCache(at.service, []string{"admins@example.com"}, 20*time.Millisecond)
+	c.Stop()
+
+	// the membership in use isn't refreshed after stopping
+	assert.Equal(t, true, c.IsMember("michael.bland@gsa.gov"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, at.requests)
+}
@@ -1,10 +1,15 @@
 package providers
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/bitly/oauth2_proxy/api"
 )
@@ -73,6 +78,78 @@ func validateToken(p Provider, access_token string, header http.Header) bool {
 	return false
 }
 
+// introspectToken looks up an opaque access token at the provider's RFC 7662
+// IntrospectURL and returns a session for it if the token is active
+func introspectToken(p Provider, access_token string) (*SessionState, error) {
+	if access_token == "" || p.Data().IntrospectURL == nil {
+		return nil, errors.New("missing access token or introspection url")
+	}
+	params := url.Values{}
+	params.Add("token", access_token)
+	params.Add("token_type_hint", "access_token")
+	p.Data().addClientCredentials(params)
+
+	endpoint := p.Data().IntrospectURL.String()
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var introspection struct {
+		Active   bool   `json:"active"`
+		Subject  string `json:"sub"`
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Scope    string `json:"scope"`
+		Expiry   int64  `json:"exp"`
+		ClientID string `json:"client_id"`
+		// Audience is a string or a list of strings
+		Audience interface{} `json:"aud"`
+	}
+	err = api.RequestJson(req, &introspection)
+	if err != nil {
+		return nil, fmt.Errorf("token introspection request failed: %s", err)
+	}
+	if !introspection.Active {
+		return nil, errors.New("token is not active")
+	}
+	// any client of the provider can get an active token, it has to have
+	// been issued to this one or name it as its audience
+	clientID := p.Data().ClientID
+	issuedTo := clientID != "" && introspection.ClientID == clientID
+	for _, audience := range claimStrings(introspection.Audience) {
+		issuedTo = issuedTo || (clientID != "" && audience == clientID)
+	}
+	if !issuedTo {
+		return nil, fmt.Errorf("token was issued to client %q, not %q", introspection.ClientID, clientID)
+	}
+
+	s := &SessionState{
+		AccessToken: access_token,
+		Email:       introspection.Email,
+		User:        introspection.Username,
+		Claims: map[string]interface{}{
+			"sub":   introspection.Subject,
+			"scope": introspection.Scope,
+		},
+	}
+	if s.User == "" && s.Email != "" {
+		s.User = strings.Split(s.Email, "@")[0]
+	}
+	if s.User == "" {
+		s.User = introspection.Subject
+	}
+	if introspection.Expiry != 0 {
+		s.ExpiresOn = time.Unix(introspection.Expiry, 0)
+		if s.IsExpired() {
+			return nil, errors.New("token is expired")
+		}
+	}
+	return s, nil
+}
+
 func updateURL(url *url.URL, hostname string) {
 	url.Scheme = "http"
 	url.Host = hostname
@@ -0,0 +1,68 @@
+package providers
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenIntrospector turns opaque bearer tokens into sessions using the
+// provider's introspection endpoint. Active tokens are cached until they
+// expire so the endpoint isn't asked on every request.
+type TokenIntrospector struct {
+	provider Provider
+
+	mu    sync.Mutex
+	cache map[string]*SessionState
+}
+
+func NewTokenIntrospector(p Provider) *TokenIntrospector {
+	return &TokenIntrospector{
+		provider: p,
+		cache:    make(map[string]*SessionState),
+	}
+}
+
+// Introspect returns the session for an active access token
+func (t *TokenIntrospector) Introspect(access_token string) (*SessionState, error) {
+	if s := t.cached(access_token); s != nil {
+		return s, nil
+	}
+	s, err := introspectToken(t.provider, access_token)
+	if err != nil {
+		return nil, err
+	}
+	// tokens without an expiry are looked up again on the next request
+	if !s.ExpiresOn.IsZero() {
+		t.store(access_token, s)
+	}
+	return s, nil
+}
+
+func (t *TokenIntrospector) cached(access_token string) *SessionState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.cache[access_token]
+	if !ok {
+		return nil
+	}
+	if s.IsExpired() {
+		delete(t.cache, access_token)
+		return nil
+	}
+	// callers may change the session, keep the cached one intact
+	copied := *s
+	return &copied
+}
+
+func (t *TokenIntrospector) store(access_token string, s *SessionState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for token, cached := range t.cache {
+		if cached.ExpiresOn.Before(now) {
+			delete(t.cache, token)
+		}
+	}
+	copied := *s
+	t.cache[access_token] = &copied
+}
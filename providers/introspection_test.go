@@ -0,0 +1,170 @@
+package providers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type IntrospectionTest struct {
+	backend  *httptest.Server
+	provider *ValidateSessionStateTestProvider
+	// form of the last introspection request
+	request  url.Values
+	requests int
+	response map[string]interface{}
+}
+
+func NewIntrospectionTest() *IntrospectionTest {
+	var it_test IntrospectionTest
+	it_test.backend = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			it_test.request = r.PostForm
+			it_test.requests++
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(it_test.response)
+		}))
+	backend_url, _ := url.Parse(it_test.backend.URL)
+	backend_url.Path = "/oauth/introspect"
+	it_test.provider = &ValidateSessionStateTestProvider{
+		ProviderData: &ProviderData{
+			ClientID:      "bazquux",
+			ClientSecret:  "xyzzyplugh",
+			IntrospectURL: backend_url,
+		},
+	}
+	it_test.response = map[string]interface{}{
+		"active":    true,
+		"sub":       "123456789",
+		"email":     "michael.bland@gsa.gov",
+		"scope":     "read write",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"client_id": "bazquux",
+	}
+	return &it_test
+}
+
+func (it_test *IntrospectionTest) Close() {
+	it_test.backend.Close()
+}
+
+func TestIntrospectToken(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+
+	s, err := introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "opaque_token", it_test.request.Get("token"))
+	assert.Equal(t, "access_token", it_test.request.Get("token_type_hint"))
+	assert.Equal(t, "bazquux", it_test.request.Get("client_id"))
+	assert.Equal(t, "xyzzyplugh", it_test.request.Get("client_secret"))
+
+	assert.Equal(t, "opaque_token", s.AccessToken)
+	assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	assert.Equal(t, "michael.bland", s.User)
+	assert.Equal(t, "123456789", s.Claims["sub"])
+	assert.Equal(t, "read write", s.Claims["scope"])
+	assert.Equal(t, it_test.response["exp"], s.ExpiresOn.Unix())
+}
+
+func TestIntrospectTokenWithoutEmail(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+	delete(it_test.response, "email")
+
+	s, err := introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", s.Email)
+	assert.Equal(t, "123456789", s.User)
+
+	it_test.response["username"] = "mbland"
+	s, err = introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", s.User)
+}
+
+func TestIntrospectTokenInactive(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+	it_test.response = map[string]interface{}{"active": false}
+
+	s, err := introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, (*SessionState)(nil), s)
+	assert.Equal(t, "token is not active", err.Error())
+}
+
+func TestIntrospectTokenIssuedToAnotherClient(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+	it_test.response["client_id"] = "some-other-client"
+
+	s, err := introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, (*SessionState)(nil), s)
+	assert.Equal(t, `token was issued to client "some-other-client", not "bazquux"`, err.Error())
+
+	// a token for another client that names this one as its audience
+	it_test.response["aud"] = []string{"some-api", "bazquux"}
+	_, err = introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, nil, err)
+
+	delete(it_test.response, "client_id")
+	it_test.response["aud"] = "bazquux"
+	_, err = introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, nil, err)
+
+	delete(it_test.response, "aud")
+	_, err = introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, `token was issued to client "", not "bazquux"`, err.Error())
+}
+
+func TestIntrospectTokenExpired(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+	it_test.response["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	_, err := introspectToken(it_test.provider, "opaque_token")
+	assert.Equal(t, "token is expired", err.Error())
+}
+
+func TestTokenIntrospectorCachesUntilExpiry(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+	introspector := NewTokenIntrospector(it_test.provider)
+
+	for i := 0; i < 3; i++ {
+		s, err := introspector.Introspect("opaque_token")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	}
+	assert.Equal(t, 1, it_test.requests)
+
+	_, err := introspector.Introspect("other_token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, it_test.requests)
+
+	// the cached session has expired
+	introspector.cache["opaque_token"].ExpiresOn = time.Now().Add(-time.Second)
+	_, err = introspector.Introspect("opaque_token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, it_test.requests)
+}
+
+func TestTokenIntrospectorDoesNotCacheFailures(t *testing.T) {
+	it_test := NewIntrospectionTest()
+	defer it_test.Close()
+	introspector := NewTokenIntrospector(it_test.provider)
+	it_test.response = map[string]interface{}{"active": false}
+
+	_, err := introspector.Introspect("opaque_token")
+	assert.NotEqual(t, nil, err)
+	_, err = introspector.Introspect("opaque_token")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 2, it_test.requests)
+	assert.Equal(t, 0, len(introspector.cache))
+}
@@ -0,0 +1,222 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+type KeycloakProvider struct {
+	*ProviderData
+	// Groups and Roles restrict logins to members of one of the groups that
+	// have one of the roles. Roles of a client are given as "<client>:<role>".
+	Groups []string
+	Roles  []string
+}
+
+func NewKeycloakProvider(p *ProviderData) *KeycloakProvider {
+	p.ProviderName = "Keycloak"
+	if p.Scope == "" {
+		p.Scope = "openid email profile"
+	}
+	return &KeycloakProvider{ProviderData: p}
+}
+
+// Configure derives the endpoints that aren't set from the realm URL, ie:
+// https://keycloak.example.com/auth/realms/myrealm
+func (p *KeycloakProvider) Configure(realmURL *url.URL) {
+	endpoint := func(name string) *url.URL {
+		u := *realmURL
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/protocol/openid-connect/" + name
+		return &u
+	}
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = endpoint("auth")
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = endpoint("token")
+	}
+	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
+		p.ProfileURL = endpoint("userinfo")
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = endpoint("userinfo")
+	}
+}
+
+func (p *KeycloakProvider) SetAllowedGroupsRoles(groups, roles []string) {
+	p.Groups = groups
+	p.Roles = roles
+}
+
+func (p *KeycloakProvider) Redeem(redirectURL, code, codeVerifier string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	p.addClientCredentials(params)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+
+	s := &SessionState{}
+	if err := p.redeemToken(params, s); err != nil {
+		return nil, err
+	}
+	if err := p.updateSession(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RefreshSessionIfNeeded redeems the refresh token once the access token
+// expired, and checks the user's groups and roles again
+func (p *KeycloakProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	params := url.Values{}
+	p.addClientCredentials(params)
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+
+	origExpiration := s.ExpiresOn
+	if err := p.redeemToken(params, s); err != nil {
+		return false, err
+	}
+	if err := p.updateSession(s); err != nil {
+		return false, err
+	}
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+func (p *KeycloakProvider) ValidateSessionState(s *SessionState) bool {
+	return validateToken(p, s.AccessToken, getKeycloakHeader(s.AccessToken))
+}
+
+// updateSession sets the user's email, groups and roles from the claims of
+// the access token and the userinfo endpoint, which takes precedence, and
+// checks them against the restrictions
+func (p *KeycloakProvider) updateSession(s *SessionState) error {
+	claims, err := keycloakTokenClaims(s.AccessToken)
+	if err != nil {
+		log.Printf("unable to read keycloak access token claims: %s", err)
+		claims = make(map[string]interface{})
+	}
+	if p.ProfileURL != nil && p.ProfileURL.String() != "" {
+		req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header = getKeycloakHeader(s.AccessToken)
+		var userinfo map[string]interface{}
+		if err := api.RequestJson(req, &userinfo); err != nil {
+			return err
+		}
+		for k, v := range userinfo {
+			claims[k] = v
+		}
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return errors.New("missing email")
+	}
+	if s.Email != "" && s.Email != email {
+		return fmt.Errorf("email changed from %s to %s", s.Email, email)
+	}
+	s.Email = email
+	if username, ok := claims["preferred_username"].(string); ok {
+		s.PreferredUsername = username
+	}
+	s.Groups = claimStrings(claims["groups"])
+
+	roles := claimStrings(nestedClaim(claims, "realm_access.roles"))
+	if clients, ok := claims["resource_access"].(map[string]interface{}); ok {
+		for client, access := range clients {
+			access, _ := access.(map[string]interface{})
+			for _, role := range claimStrings(access["roles"]) {
+				roles = append(roles, client+":"+role)
+			}
+		}
+	}
+	if s.Claims == nil {
+		s.Claims = make(map[string]interface{})
+	}
+	s.Claims["roles"] = roles
+
+	if !p.hasAllowedGroup(s.Groups) {
+		return fmt.Errorf("%s is not in the keycloak group(s) %v", s.Email, p.Groups)
+	}
+	if !p.hasAllowedRole(roles) {
+		return fmt.Errorf("%s does not have the keycloak role(s) %v", s.Email, p.Roles)
+	}
+	return nil
+}
+
+// hasAllowedGroup matches groups with or without the leading "/" of their
+// full path
+func (p *KeycloakProvider) hasAllowedGroup(groups []string) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, allowed := range p.Groups {
+		for _, group := range groups {
+			if strings.TrimPrefix(group, "/") == strings.TrimPrefix(allowed, "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *KeycloakProvider) hasAllowedRole(roles []string) bool {
+	if len(p.Roles) == 0 {
+		return true
+	}
+	for _, allowed := range p.Roles {
+		for _, role := range roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getKeycloakHeader(access_token string) http.Header {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
+	return header
+}
+
+// keycloakTokenClaims decodes the payload of a Keycloak access token. Its
+// signature isn't checked, the token was received from Keycloak directly.
+func keycloakTokenClaims(access_token string) (map[string]interface{}, error) {
+	jwt := strings.Split(access_token, ".")
+	if len(jwt) != 3 {
+		return nil, errors.New("access token is not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwt[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,180 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type keycloakTestBackend struct {
+	*httptest.Server
+	// claims of the access tokens the token endpoint returns
+	claims map[string]interface{}
+	// the userinfo endpoint response
+	userinfo map[string]interface{}
+	// form of the last token request
+	tokenRequest url.Values
+}
+
+func newKeycloakTestBackend() *keycloakTestBackend {
+	b := &keycloakTestBackend{
+		claims: map[string]interface{}{
+			"realm_access": map[string]interface{}{
+				"roles": []string{"offline_access", "admin"},
+			},
+			"resource_access": map[string]interface{}{
+				"dashboard": map[string]interface{}{
+					"roles": []string{"viewer"},
+				},
+			},
+		},
+		userinfo: map[string]interface{}{
+			"email":              "michael.bland@gsa.gov",
+			"preferred_username": "mbland",
+			"groups":             []string{"/admins", "/users"},
+		},
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/auth/realms/test/protocol/openid-connect/token":
+			r.ParseForm()
+			b.tokenRequest = r.PostForm
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  b.accessToken(),
+				"refresh_token": "imaginary_refresh_token",
+				"expires_in":    300,
+			})
+		case "/auth/realms/test/protocol/openid-connect/userinfo":
+			if r.Header.Get("Authorization") != "Bearer "+b.accessToken() {
+				w.WriteHeader(401)
+				return
+			}
+			json.NewEncoder(w).Encode(b.userinfo)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return b
+}
+
+func (b *keycloakTestBackend) accessToken() string {
+	payload, _ := json.Marshal(b.claims)
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func testKeycloakProvider(b *keycloakTestBackend) *KeycloakProvider {
+	p := NewKeycloakProvider(&ProviderData{
+		ClientID:     "bazquux",
+		ClientSecret: "xyzzyplugh",
+		LoginURL:     &url.URL{},
+		RedeemURL:    &url.URL{},
+		ProfileURL:   &url.URL{},
+		ValidateURL:  &url.URL{}})
+	realmURL, _ := url.Parse(b.URL + "/auth/realms/test/")
+	p.Configure(realmURL)
+	return p
+}
+
+func TestKeycloakProviderDefaults(t *testing.T) {
+	p := NewKeycloakProvider(&ProviderData{
+		LoginURL:  &url.URL{},
+		RedeemURL: &url.URL{Scheme: "https", Host: "sso.example.com", Path: "/token"}})
+	realmURL, _ := url.Parse("https://keycloak.example.com/auth/realms/myrealm")
+	p.Configure(realmURL)
+	assert.Equal(t, "Keycloak", p.Data().ProviderName)
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+	assert.Equal(t, "https://keycloak.example.com/auth/realms/myrealm/protocol/openid-connect/auth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://sso.example.com/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://keycloak.example.com/auth/realms/myrealm/protocol/openid-connect/userinfo",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://keycloak.example.com/auth/realms/myrealm/protocol/openid-connect/userinfo",
+		p.Data().ValidateURL.String())
+}
+
+func TestKeycloakProviderRedeem(t *testing.T) {
+	b := newKeycloakTestBackend()
+	defer b.Close()
+	p := testKeycloakProvider(b)
+
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "authorization_code", b.tokenRequest.Get("grant_type"))
+	assert.Equal(t, "code1234", b.tokenRequest.Get("code"))
+	assert.Equal(t, b.accessToken(), s.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.Equal(t, "michael.bland@gsa.gov", s.Email)
+	assert.Equal(t, "mbland", s.PreferredUsername)
+	assert.Equal(t, []string{"/admins", "/users"}, s.Groups)
+	assert.Equal(t, []string{"offline_access", "admin", "dashboard:viewer"}, s.Claims["roles"])
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+}
+
+func TestKeycloakProviderRedeemRestrictions(t *testing.T) {
+	b := newKeycloakTestBackend()
+	defer b.Close()
+	p := testKeycloakProvider(b)
+
+	for _, allowed := range []struct {
+		groups, roles []string
+		ok            bool
+	}{
+		{[]string{"admins"}, nil, true},
+		{[]string{"/users"}, nil, true},
+		{[]string{"ops"}, nil, false},
+		{nil, []string{"admin"}, true},
+		{nil, []string{"dashboard:viewer"}, true},
+		{nil, []string{"viewer"}, false},
+		{[]string{"admins"}, []string{"dashboard:editor"}, false},
+	} {
+		p.SetAllowedGroupsRoles(allowed.groups, allowed.roles)
+		_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234", "")
+		assert.Equal(t, allowed.ok, err == nil, "%v %v", allowed.groups, allowed.roles)
+	}
+}
+
+func TestKeycloakProviderRefreshChecksRoles(t *testing.T) {
+	b := newKeycloakTestBackend()
+	defer b.Close()
+	p := testKeycloakProvider(b)
+	p.SetAllowedGroupsRoles(nil, []string{"admin"})
+
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, nil, err)
+
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "refresh_token", b.tokenRequest.Get("grant_type"))
+	assert.Equal(t, "imaginary_refresh_token", b.tokenRequest.Get("refresh_token"))
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+
+	// the role was taken away
+	b.claims["realm_access"] = map[string]interface{}{"roles": []string{"offline_access"}}
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "michael.bland@gsa.gov does not have the keycloak role(s) [admin]", err.Error())
+}
+
+func TestKeycloakProviderValidateSessionState(t *testing.T) {
+	b := newKeycloakTestBackend()
+	defer b.Close()
+	p := testKeycloakProvider(b)
+
+	assert.Equal(t, true, p.ValidateSessionState(&SessionState{AccessToken: b.accessToken()}))
+	assert.Equal(t, false, p.ValidateSessionState(&SessionState{AccessToken: "revoked"}))
+}
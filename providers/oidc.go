@@ -3,6 +3,9 @@ package providers
 import (
 	"context"
 	"fmt"
+	"log"
+	"net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -14,15 +17,20 @@ type OIDCProvider struct {
 	*ProviderData
 
 	Verifier *oidc.IDTokenVerifier
+	// EndSessionURL is the end_session_endpoint used for RP-initiated
+	// logout; logging out of the provider is disabled when nil
+	EndSessionURL *url.URL
+	// GroupsClaim names the claim holding the user's groups, nested claims
+	// are separated by dots (ie: realm_access.roles)
+	GroupsClaim string
 }
 
 func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 	p.ProviderName = "OpenID Connect"
-	return &OIDCProvider{ProviderData: p}
+	return &OIDCProvider{ProviderData: p, GroupsClaim: "groups"}
 }
 
-func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
-	ctx := context.Background()
+func (p *OIDCProvider) oauth2Config(redirectURL string) oauth2.Config {
 	c := oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -31,7 +39,30 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err er
 		},
 		RedirectURL: redirectURL,
 	}
-	token, err := c.Exchange(ctx, code)
+	if p.PublicClient {
+		c.ClientSecret = ""
+	}
+	return c
+}
+
+// ConfigurePublicClient makes token requests of a public client send the
+// client_id as a parameter rather than basic auth with an empty secret. The
+// oauth2 package keeps these token URLs in a global list, so it is called
+// once when the provider is configured.
+func (p *OIDCProvider) ConfigurePublicClient() {
+	if p.PublicClient && p.RedeemURL != nil {
+		oauth2.RegisterBrokenAuthHeaderProvider(p.RedeemURL.String())
+	}
+}
+
+func (p *OIDCProvider) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
+	ctx := context.Background()
+	c := p.oauth2Config(redirectURL)
+	var opts []oauth2.AuthCodeOption
+	if codeVerifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	}
+	token, err := c.Exchange(ctx, code, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
@@ -41,20 +72,46 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err er
 		return nil, fmt.Errorf("token response did not contain an id_token")
 	}
 
+	return p.createSessionState(ctx, token, rawIDToken)
+}
+
+// createSessionState verifies rawIDToken and returns a session holding its
+// claims along with the tokens from token
+func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Token, rawIDToken string) (*SessionState, error) {
 	// Parse and verify ID Token payload.
 	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
 	if err != nil {
 		return nil, fmt.Errorf("could not verify id_token: %v", err)
 	}
 
+	s, err := SessionFromIDToken(idToken, p.GroupsClaim)
+	if err != nil {
+		return nil, err
+	}
+	s.AccessToken = token.AccessToken
+	s.IDToken = rawIDToken
+	s.RefreshToken = token.RefreshToken
+	s.ExpiresOn = token.Expiry
+	return s, nil
+}
+
+// SessionFromIDToken returns a session with the user's email, name, groups
+// and the other claims of a verified id_token. groupsClaim names the claim
+// holding the groups, see OIDCProvider.GroupsClaim.
+func SessionFromIDToken(idToken *oidc.IDToken, groupsClaim string) (*SessionState, error) {
 	// Extract custom claims.
 	var claims struct {
-		Email    string `json:"email"`
-		Verified *bool  `json:"email_verified"`
+		Email             string `json:"email"`
+		Verified          *bool  `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
 	}
+	var allClaims map[string]interface{}
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
 
 	if claims.Email == "" {
 		return nil, fmt.Errorf("id_token did not contain an email")
@@ -63,14 +120,98 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err er
 		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
 	}
 
-	s = &SessionState{
-		AccessToken:  token.AccessToken,
-		RefreshToken: token.RefreshToken,
-		ExpiresOn:    token.Expiry,
-		Email:        claims.Email,
+	return &SessionState{
+		ExpiresOn:         idToken.Expiry,
+		Email:             claims.Email,
+		PreferredUsername: claims.PreferredUsername,
+		Groups:            claimStrings(nestedClaim(allClaims, groupsClaim)),
+		Claims:            allClaims,
+	}, nil
+}
+
+// GetLogoutURL returns the end_session_endpoint with the id_token of s as a
+// hint and redirectURI to return to after logging out
+func (p *OIDCProvider) GetLogoutURL(s *SessionState, redirectURI string) string {
+	if p.EndSessionURL == nil {
+		return ""
+	}
+	var a url.URL
+	a = *p.EndSessionURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	if s != nil && s.IDToken != "" {
+		params.Set("id_token_hint", s.IDToken)
+	}
+	if redirectURI != "" {
+		params.Set("post_logout_redirect_uri", redirectURI)
+	}
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// backChannelLogoutEvent identifies logout tokens, see
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// VerifyLogoutToken verifies a back-channel logout token with the keys used
+// for id_tokens and returns the sid and sub it logs out
+func (p *OIDCProvider) VerifyLogoutToken(rawToken string) (sid, sub string, err error) {
+	token, err := p.Verifier.Verify(context.Background(), rawToken)
+	if err != nil {
+		return "", "", fmt.Errorf("could not verify logout_token: %v", err)
+	}
+	var claims struct {
+		Sid    string                 `json:"sid"`
+		Events map[string]interface{} `json:"events"`
+		Nonce  string                 `json:"nonce"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return "", "", fmt.Errorf("failed to parse logout_token claims: %v", err)
+	}
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return "", "", fmt.Errorf("logout_token is missing the back-channel logout event")
+	}
+	if claims.Nonce != "" {
+		return "", "", fmt.Errorf("logout_token must not contain a nonce")
+	}
+	if claims.Sid == "" && token.Subject == "" {
+		return "", "", fmt.Errorf("logout_token contains neither sid nor sub")
+	}
+	return claims.Sid, token.Subject, nil
+}
+
+// nestedClaim returns the claim at the dot separated path, unless there is a
+// claim named path itself
+func nestedClaim(claims map[string]interface{}, path string) interface{} {
+	if claim, ok := claims[path]; ok {
+		return claim
+	}
+	var claim interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := claim.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		claim = m[name]
 	}
+	return claim
+}
 
-	return
+// claimStrings returns a claim that is either a string or a list of strings
+// as a list
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
 }
 
 func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
@@ -79,7 +220,46 @@ func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 	}
 
 	origExpiration := s.ExpiresOn
-	s.ExpiresOn = time.Now().Add(time.Second).Truncate(time.Second)
-	fmt.Printf("refreshed access token %s (expired on %s)\n", s, origExpiration)
-	return false, nil
+	if err := p.redeemRefreshToken(s); err != nil {
+		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+	}
+
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+func (p *OIDCProvider) redeemRefreshToken(s *SessionState) error {
+	ctx := context.Background()
+	c := p.oauth2Config("")
+	t := &oauth2.Token{
+		RefreshToken: s.RefreshToken,
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	token, err := c.TokenSource(ctx, t).Token()
+	if err != nil {
+		return err
+	}
+
+	// the id_token is optional in refresh responses, keep the claims of the
+	// one we already have when there's none
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		s.AccessToken = token.AccessToken
+		s.RefreshToken = token.RefreshToken
+		s.ExpiresOn = token.Expiry
+		return nil
+	}
+
+	newSession, err := p.createSessionState(ctx, token, rawIDToken)
+	if err != nil {
+		return err
+	}
+	if s.Email != newSession.Email {
+		return fmt.Errorf("id_token email changed from %s to %s", s.Email, newSession.Email)
+	}
+	// the user name and the provider don't come from the id_token
+	user, provider := s.User, s.Provider
+	*s = *newSession
+	s.User, s.Provider = user, provider
+	return nil
 }
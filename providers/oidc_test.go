@@ -0,0 +1,365 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const oidcClientID = "bazquux"
+
+type oidcTestBackend struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// claims for the id_token returned from the token endpoint
+	claims map[string]interface{}
+	// form of the last token request
+	tokenRequest url.Values
+	// refresh token requests fail when set
+	rejectRefresh bool
+	// refresh token responses leave out the id_token when set
+	refreshWithoutIDToken bool
+}
+
+func newOIDCTestBackend(t *testing.T) *oidcTestBackend {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	b := &oidcTestBackend{key: key}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	b.claims = map[string]interface{}{
+		"sub":                "123456789",
+		"email":              "michael.bland@gsa.gov",
+		"email_verified":     true,
+		"preferred_username": "mbland",
+		"groups":             []string{"admins", "users"},
+	}
+	return b
+}
+
+func (b *oidcTestBackend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 b.URL,
+			"authorization_endpoint": b.URL + "/authorize",
+			"token_endpoint":         b.URL + "/token",
+			"jwks_uri":               b.URL + "/keys",
+		})
+	case "/keys":
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &b.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	case "/token":
+		r.ParseForm()
+		b.tokenRequest = r.PostForm
+		resp := map[string]interface{}{
+			"access_token":  "imaginary_access_token",
+			"refresh_token": "imaginary_refresh_token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"id_token":      b.idToken(b.claims),
+		}
+		if r.PostForm.Get("grant_type") == "refresh_token" {
+			if b.rejectRefresh {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			resp["access_token"] = "refreshed_access_token"
+			resp["refresh_token"] = "refreshed_refresh_token"
+			if b.refreshWithoutIDToken {
+				delete(resp, "id_token")
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// idToken returns a signed id_token for claims, adding the standard ones
+func (b *oidcTestBackend) idToken(claims map[string]interface{}) string {
+	all := map[string]interface{}{
+		"iss": b.URL,
+		"aud": oidcClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: b.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		panic(err)
+	}
+	payload, _ := json.Marshal(all)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		panic(err)
+	}
+	token, _ := jws.CompactSerialize()
+	return token
+}
+
+func testOIDCProvider(t *testing.T, b *oidcTestBackend) *OIDCProvider {
+	provider, err := oidc.NewProvider(context.Background(), b.URL)
+	if err != nil {
+		t.Fatalf("unable to discover test provider: %s", err)
+	}
+	redeemURL, _ := url.Parse(b.URL + "/token")
+	p := NewOIDCProvider(&ProviderData{
+		ClientID:     oidcClientID,
+		ClientSecret: "xyzzyplugh",
+		RedeemURL:    redeemURL,
+	})
+	p.Verifier = provider.Verifier(&oidc.Config{ClientID: oidcClientID})
+	return p
+}
+
+func TestOIDCProviderRedeem(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	assert.Equal(t, "imaginary_access_token", session.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", session.RefreshToken)
+	assert.NotEqual(t, "", session.IDToken)
+	assert.Equal(t, "mbland", session.PreferredUsername)
+	assert.Equal(t, []string{"admins", "users"}, session.Groups)
+	assert.Equal(t, "123456789", session.Claims["sub"])
+}
+
+func TestOIDCProviderRedeemPublicClientWithCodeVerifier(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+	p.PublicClient = true
+	p.ConfigurePublicClient()
+
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "verifier")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "verifier", b.tokenRequest.Get("code_verifier"))
+	assert.Equal(t, "", b.tokenRequest.Get("client_secret"))
+}
+
+func TestOIDCProviderRedeemUnverifiedEmail(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+	b.claims["email_verified"] = false
+
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, fmt.Errorf("email in id_token (michael.bland@gsa.gov) isn't verified"), err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+func TestOIDCProviderRedeemNestedGroupsClaim(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+	p.GroupsClaim = "realm_access.roles"
+	b.claims["realm_access"] = map[string]interface{}{"roles": []string{"admin"}}
+
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admin"}, session.Groups)
+}
+
+func TestNestedClaim(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups":                   []interface{}{"users"},
+		"https://example.com/role": "admin",
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"admin"},
+		},
+	}
+	assert.Equal(t, []interface{}{"users"}, nestedClaim(claims, "groups"))
+	assert.Equal(t, "admin", nestedClaim(claims, "https://example.com/role"))
+	assert.Equal(t, []interface{}{"admin"}, nestedClaim(claims, "realm_access.roles"))
+	assert.Equal(t, nil, nestedClaim(claims, "realm_access.missing"))
+	assert.Equal(t, nil, nestedClaim(claims, "groups.nested"))
+}
+
+func TestClaimStrings(t *testing.T) {
+	assert.Equal(t, []string{"admins"}, claimStrings("admins"))
+	assert.Equal(t, []string{"admins", "users"},
+		claimStrings([]interface{}{"admins", 1, "users"}))
+	assert.Equal(t, []string(nil), claimStrings(nil))
+}
+
+func expiredOIDCSession() *SessionState {
+	return &SessionState{
+		Email:        "michael.bland@gsa.gov",
+		User:         "michael.bland",
+		AccessToken:  "imaginary_access_token",
+		IDToken:      "imaginary_id_token",
+		RefreshToken: "imaginary_refresh_token",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+}
+
+func TestOIDCProviderRefreshSessionIfNeeded(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+	b.claims["groups"] = []string{"admins"}
+
+	session := expiredOIDCSession()
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "refresh_token", b.tokenRequest.Get("grant_type"))
+	assert.Equal(t, "imaginary_refresh_token", b.tokenRequest.Get("refresh_token"))
+	assert.Equal(t, "refreshed_access_token", session.AccessToken)
+	assert.Equal(t, "refreshed_refresh_token", session.RefreshToken)
+	assert.NotEqual(t, "imaginary_id_token", session.IDToken)
+	assert.Equal(t, []string{"admins"}, session.Groups)
+	assert.Equal(t, "michael.bland", session.User)
+	assert.Equal(t, false, session.IsExpired())
+}
+
+func TestOIDCProviderRefreshKeepsProvider(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+
+	session := expiredOIDCSession()
+	session.Provider = "contractors"
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.NotEqual(t, "imaginary_id_token", session.IDToken)
+	assert.Equal(t, "contractors", session.Provider)
+	assert.Equal(t, "michael.bland", session.User)
+}
+
+func TestOIDCProviderRefreshWithoutIDToken(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+	b.refreshWithoutIDToken = true
+
+	session := expiredOIDCSession()
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "refreshed_access_token", session.AccessToken)
+	assert.Equal(t, "imaginary_id_token", session.IDToken)
+	assert.Equal(t, false, session.IsExpired())
+}
+
+func TestOIDCProviderRefreshRejected(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+	b.rejectRefresh = true
+
+	refreshed, err := p.RefreshSessionIfNeeded(expiredOIDCSession())
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, refreshed)
+}
+
+func TestOIDCProviderRefreshNotNeeded(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+
+	session := expiredOIDCSession()
+	session.ExpiresOn = time.Now().Add(time.Minute)
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, url.Values(nil), b.tokenRequest)
+}
+
+func TestOIDCProviderGetLogoutURL(t *testing.T) {
+	p := NewOIDCProvider(&ProviderData{})
+	session := &SessionState{IDToken: "my_id_token"}
+	assert.Equal(t, "", p.GetLogoutURL(session, "https://example.com/"))
+
+	p.EndSessionURL, _ = url.Parse("https://idp.example.com/logout?client=foo")
+	logoutURL, _ := url.Parse(p.GetLogoutURL(session, "https://example.com/"))
+	assert.Equal(t, "/logout", logoutURL.Path)
+	assert.Equal(t, "foo", logoutURL.Query().Get("client"))
+	assert.Equal(t, "my_id_token", logoutURL.Query().Get("id_token_hint"))
+	assert.Equal(t, "https://example.com/", logoutURL.Query().Get("post_logout_redirect_uri"))
+
+	// no session to hint with
+	logoutURL, _ = url.Parse(p.GetLogoutURL(nil, "https://example.com/"))
+	assert.Equal(t, "", logoutURL.Query().Get("id_token_hint"))
+}
+
+func logoutTokenClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "123456789",
+		"sid": "session1",
+		"events": map[string]interface{}{
+			"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{},
+		},
+	}
+}
+
+func TestOIDCProviderVerifyLogoutToken(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+
+	sid, sub, err := p.VerifyLogoutToken(b.idToken(logoutTokenClaims()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "session1", sid)
+	assert.Equal(t, "123456789", sub)
+
+	claims := logoutTokenClaims()
+	delete(claims, "sid")
+	sid, sub, err = p.VerifyLogoutToken(b.idToken(claims))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", sid)
+	assert.Equal(t, "123456789", sub)
+}
+
+func TestOIDCProviderVerifyLogoutTokenRejected(t *testing.T) {
+	b := newOIDCTestBackend(t)
+	defer b.Close()
+	p := testOIDCProvider(t, b)
+
+	// an id_token isn't a logout token
+	_, _, err := p.VerifyLogoutToken(b.idToken(b.claims))
+	assert.NotEqual(t, nil, err)
+
+	claims := logoutTokenClaims()
+	claims["nonce"] = "abcdef"
+	_, _, err = p.VerifyLogoutToken(b.idToken(claims))
+	assert.NotEqual(t, nil, err)
+
+	claims = logoutTokenClaims()
+	delete(claims, "sid")
+	delete(claims, "sub")
+	_, _, err = p.VerifyLogoutToken(b.idToken(claims))
+	assert.NotEqual(t, nil, err)
+
+	// signed by someone else
+	other := newOIDCTestBackend(t)
+	defer other.Close()
+	_, _, err = p.VerifyLogoutToken(other.idToken(logoutTokenClaims()))
+	assert.NotEqual(t, nil, err)
+}
@@ -5,6 +5,9 @@ import (
 )
 
 type ProviderData struct {
+	// ProviderID names one of several configured providers in sessions and
+	// callback paths; it's empty for the default provider
+	ProviderID        string
 	ProviderName      string
 	ClientID          string
 	ClientSecret      string
@@ -13,8 +16,11 @@ type ProviderData struct {
 	ProfileURL        *url.URL
 	ProtectedResource *url.URL
 	ValidateURL       *url.URL
+	IntrospectURL     *url.URL
 	Scope             string
 	ApprovalPrompt    string
+	// PublicClient omits the client secret from token requests
+	PublicClient bool
 }
 
 func (p *ProviderData) Data() *ProviderData { return p }
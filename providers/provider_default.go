@@ -8,11 +8,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/bitly/oauth2_proxy/cookie"
 )
 
-func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err error) {
+func (p *ProviderData) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -20,10 +21,12 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 
 	params := url.Values{}
 	params.Add("redirect_uri", redirectURL)
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
+	p.addClientCredentials(params)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
 		params.Add("resource", p.ProtectedResource.String())
 	}
@@ -77,8 +80,63 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 	return
 }
 
-// GetLoginURL with typical oauth parameters
-func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
+// redeemToken posts params to the token endpoint and keeps the tokens of
+// the response in s
+func (p *ProviderData) redeemToken(params url.Values, s *SessionState) error {
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var jsonResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return err
+	}
+	if jsonResponse.AccessToken == "" {
+		return fmt.Errorf("no access token found %s", body)
+	}
+	s.AccessToken = jsonResponse.AccessToken
+	s.ExpiresOn = time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second)
+	if jsonResponse.RefreshToken != "" {
+		s.RefreshToken = jsonResponse.RefreshToken
+	}
+	if jsonResponse.IDToken != "" {
+		s.IDToken = jsonResponse.IDToken
+	}
+	return nil
+}
+
+// addClientCredentials adds the client id and, unless this is a public
+// client, the client secret to the parameters of a token request
+func (p *ProviderData) addClientCredentials(params url.Values) {
+	params.Add("client_id", p.ClientID)
+	if !p.PublicClient {
+		params.Add("client_secret", p.ClientSecret)
+	}
+}
+
+// GetLoginURL with typical oauth parameters, including a PKCE S256
+// challenge if codeChallenge is set
+func (p *ProviderData) GetLoginURL(redirectURI, state, codeChallenge string) string {
 	var a url.URL
 	a = *p.LoginURL
 	params, _ := url.ParseQuery(a.RawQuery)
@@ -88,10 +146,26 @@ func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	params.Set("client_id", p.ClientID)
 	params.Set("response_type", "code")
 	params.Add("state", state)
+	if codeChallenge != "" {
+		params.Set("code_challenge", codeChallenge)
+		params.Set("code_challenge_method", "S256")
+	}
 	a.RawQuery = params.Encode()
 	return a.String()
 }
 
+// GetLogoutURL returns the URL that signs the user out of the provider, or
+// an empty string if the provider has none
+func (p *ProviderData) GetLogoutURL(s *SessionState, redirectURI string) string {
+	return ""
+}
+
+// VerifyLogoutToken verifies a back-channel logout token and returns the
+// session id and subject it logs out
+func (p *ProviderData) VerifyLogoutToken(rawToken string) (sid, sub string, err error) {
+	return "", "", errors.New("not implemented")
+}
+
 // CookieForSession serializes a session state for storage in a cookie
 func (p *ProviderData) CookieForSession(s *SessionState, c *cookie.Cipher) (string, error) {
 	return s.EncodeSessionState(c)
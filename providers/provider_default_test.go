@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -15,3 +18,55 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestGetLoginURLWithCodeChallenge(t *testing.T) {
+	p := &ProviderData{
+		ClientID: "bazquux",
+		LoginURL: &url.URL{Scheme: "https", Host: "example.com", Path: "/oauth/authorize"},
+	}
+	loginURL, _ := url.Parse(p.GetLoginURL("https://proxy/oauth2/callback", "nonce:/", ""))
+	assert.Equal(t, "", loginURL.Query().Get("code_challenge"))
+	assert.Equal(t, "", loginURL.Query().Get("code_challenge_method"))
+
+	loginURL, _ = url.Parse(p.GetLoginURL("https://proxy/oauth2/callback", "nonce:/", "challenge"))
+	assert.Equal(t, "challenge", loginURL.Query().Get("code_challenge"))
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+}
+
+func newTokenRequestServer(form *url.Values) (*url.URL, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		*form = r.PostForm
+		rw.Write([]byte(`{"access_token": "a1234"}`))
+	}))
+	u, _ := url.Parse(s.URL)
+	return u, s
+}
+
+func TestRedeemWithCodeVerifier(t *testing.T) {
+	var form url.Values
+	p := &ProviderData{ClientID: "bazquux", ClientSecret: "xyzzyplugh"}
+	var server *httptest.Server
+	p.RedeemURL, server = newTokenRequestServer(&form)
+	defer server.Close()
+
+	session, err := p.Redeem("https://proxy/oauth2/callback", "code1234", "verifier")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, "verifier", form.Get("code_verifier"))
+	assert.Equal(t, "xyzzyplugh", form.Get("client_secret"))
+}
+
+func TestRedeemPublicClient(t *testing.T) {
+	var form url.Values
+	p := &ProviderData{ClientID: "bazquux", ClientSecret: "xyzzyplugh", PublicClient: true}
+	var server *httptest.Server
+	p.RedeemURL, server = newTokenRequestServer(&form)
+	defer server.Close()
+
+	_, err := p.Redeem("https://proxy/oauth2/callback", "code1234", "verifier")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bazquux", form.Get("client_id"))
+	_, sent := form["client_secret"]
+	assert.Equal(t, false, sent)
+}
@@ -8,10 +8,12 @@ type Provider interface {
 	Data() *ProviderData
 	GetEmailAddress(*SessionState) (string, error)
 	GetUserName(*SessionState) (string, error)
-	Redeem(string, string) (*SessionState, error)
+	Redeem(redirectURL, code, codeVerifier string) (*SessionState, error)
 	ValidateGroup(string) bool
 	ValidateSessionState(*SessionState) bool
-	GetLoginURL(redirectURI, finalRedirect string) string
+	GetLoginURL(redirectURI, finalRedirect, codeChallenge string) string
+	GetLogoutURL(s *SessionState, redirectURI string) string
+	VerifyLogoutToken(rawToken string) (sid, sub string, err error)
 	RefreshSessionIfNeeded(*SessionState) (bool, error)
 	SessionFromCookie(string, *cookie.Cipher) (*SessionState, error)
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
@@ -31,6 +33,10 @@ func New(provider string, p *ProviderData) Provider {
 		return NewGitLabProvider(p)
 	case "oidc":
 		return NewOIDCProvider(p)
+	case "keycloak":
+		return NewKeycloakProvider(p)
+	case "generic":
+		return NewGenericProvider(p)
 	default:
 		return NewGoogleProvider(p)
 	}
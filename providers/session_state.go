@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -10,11 +11,18 @@ import (
 )
 
 type SessionState struct {
-	AccessToken  string
-	ExpiresOn    time.Time
-	RefreshToken string
-	Email        string
-	User         string
+	AccessToken       string                 `json:"access_token,omitempty"`
+	IDToken           string                 `json:"id_token,omitempty"`
+	ExpiresOn         time.Time              `json:"expires_on"`
+	RefreshToken      string                 `json:"refresh_token,omitempty"`
+	Email             string                 `json:"email"`
+	User              string                 `json:"user"`
+	PreferredUsername string                 `json:"preferred_username,omitempty"`
+	Groups            []string               `json:"groups,omitempty"`
+	Claims            map[string]interface{} `json:"claims,omitempty"`
+	// ProviderID of the provider that issued the session, empty for the
+	// default provider
+	Provider string `json:"provider,omitempty"`
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -29,6 +37,9 @@ func (s *SessionState) String() string {
 	if s.AccessToken != "" {
 		o += " token:true"
 	}
+	if s.IDToken != "" {
+		o += " id_token:true"
+	}
 	if !s.ExpiresOn.IsZero() {
 		o += fmt.Sprintf(" expires:%s", s.ExpiresOn)
 	}
@@ -39,39 +50,36 @@ func (s *SessionState) String() string {
 }
 
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
-	if c == nil || s.AccessToken == "" {
+	// the account info doesn't hold the groups, sessions with groups are
+	// encrypted even without tokens
+	if c == nil || (s.AccessToken == "" && s.IDToken == "" && len(s.Groups) == 0) {
 		return s.accountInfo(), nil
 	}
 	return s.EncryptedString(c)
 }
 
 func (s *SessionState) accountInfo() string {
+	if s.Provider != "" {
+		return fmt.Sprintf("email:%s user:%s provider:%s", s.Email, s.User, s.Provider)
+	}
 	return fmt.Sprintf("email:%s user:%s", s.Email, s.User)
 }
 
+// EncryptedString encodes the whole session as JSON encrypted with c
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
-	var err error
 	if c == nil {
 		panic("error. missing cipher")
 	}
-	a := s.AccessToken
-	if a != "" {
-		if a, err = c.Encrypt(a); err != nil {
-			return "", err
-		}
-	}
-	r := s.RefreshToken
-	if r != "" {
-		if r, err = c.Encrypt(r); err != nil {
-			return "", err
-		}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%s|%s|%d|%s", s.accountInfo(), a, s.ExpiresOn.Unix(), r), nil
+	return c.Encrypt(string(b))
 }
 
 func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	chunks := strings.Split(v, " ")
-	if len(chunks) != 2 {
+	if len(chunks) != 2 && len(chunks) != 3 {
 		return nil, fmt.Errorf("could not decode session state: expected 2 chunks got %d", len(chunks))
 	}
 
@@ -80,8 +88,12 @@ func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	if user == "" {
 		user = strings.Split(email, "@")[0]
 	}
+	var provider string
+	if len(chunks) == 3 {
+		provider = strings.TrimPrefix(chunks[2], "provider:")
+	}
 
-	return &SessionState{User: user, Email: email}, nil
+	return &SessionState{User: user, Email: email, Provider: provider}, nil
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
@@ -89,6 +101,15 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 		return decodeSessionStatePlain(v)
 	}
 
+	if strings.HasPrefix(v, "email:") && !strings.Contains(v, "|") {
+		// saved without tokens, see EncodeSessionState
+		return decodeSessionStatePlain(v)
+	}
+	if !strings.Contains(v, "|") {
+		return decodeSessionStateJSON(v, c)
+	}
+
+	// sessions saved by older versions: account info and encrypted tokens
 	chunks := strings.Split(v, "|")
 	if len(chunks) != 4 {
 		err = fmt.Errorf("invalid number of fields (got %d expected 4)", len(chunks))
@@ -117,3 +138,18 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 
 	return sessionState, nil
 }
+
+func decodeSessionStateJSON(v string, c *cookie.Cipher) (*SessionState, error) {
+	b, err := c.Decrypt(v)
+	if err != nil {
+		return nil, err
+	}
+	var sessionState SessionState
+	if err := json.Unmarshal([]byte(b), &sessionState); err != nil {
+		return nil, fmt.Errorf("could not decode session state: %s", err)
+	}
+	if sessionState.User == "" {
+		sessionState.User = strings.Split(sessionState.Email, "@")[0]
+	}
+	return &sessionState, nil
+}
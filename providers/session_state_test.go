@@ -26,7 +26,8 @@ func TestSessionStateSerialization(t *testing.T) {
 	}
 	encoded, err := s.EncodeSessionState(c)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 3, strings.Count(encoded, "|"))
+	assert.Equal(t, 0, strings.Count(encoded, "|"))
+	assert.Equal(t, false, strings.Contains(encoded, s.Email))
 
 	ss, err := DecodeSessionState(encoded, c)
 	t.Logf("%#v", ss)
@@ -37,15 +38,12 @@ func TestSessionStateSerialization(t *testing.T) {
 	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
 	assert.Equal(t, s.RefreshToken, ss.RefreshToken)
 
-	// ensure a different cipher can't decode properly (ie: it gets gibberish)
+	// ensure a different cipher can't decode the tokens
 	ss, err = DecodeSessionState(encoded, c2)
-	t.Logf("%#v", ss)
-	assert.Equal(t, nil, err)
-	assert.Equal(t, "user", ss.User)
-	assert.Equal(t, s.Email, ss.Email)
-	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
-	assert.NotEqual(t, s.AccessToken, ss.AccessToken)
-	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
+	assert.NotEqual(t, nil, err)
+	if ss != nil {
+		t.Errorf("expected nil session state %#v", ss)
+	}
 }
 
 func TestSessionStateSerializationWithUser(t *testing.T) {
@@ -62,7 +60,8 @@ func TestSessionStateSerializationWithUser(t *testing.T) {
 	}
 	encoded, err := s.EncodeSessionState(c)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 3, strings.Count(encoded, "|"))
+	assert.Equal(t, 0, strings.Count(encoded, "|"))
+	assert.Equal(t, false, strings.Contains(encoded, s.Email))
 
 	ss, err := DecodeSessionState(encoded, c)
 	t.Logf("%#v", ss)
@@ -73,15 +72,70 @@ func TestSessionStateSerializationWithUser(t *testing.T) {
 	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
 	assert.Equal(t, s.RefreshToken, ss.RefreshToken)
 
-	// ensure a different cipher can't decode properly (ie: it gets gibberish)
+	// ensure a different cipher can't decode the tokens
 	ss, err = DecodeSessionState(encoded, c2)
-	t.Logf("%#v", ss)
+	assert.NotEqual(t, nil, err)
+	if ss != nil {
+		t.Errorf("expected nil session state %#v", ss)
+	}
+}
+
+func TestSessionStateSerializationWithClaims(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
 	assert.Equal(t, nil, err)
-	assert.Equal(t, s.User, ss.User)
+	s := &SessionState{
+		Email:             "user@domain.com",
+		IDToken:           "idtoken1234",
+		ExpiresOn:         time.Now().Add(time.Duration(1) * time.Hour),
+		PreferredUsername: "preferred",
+		Groups:            []string{"admins", "users"},
+		Claims:            map[string]interface{}{"sub": "123456789", "level": 3.0},
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user", ss.User)
 	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, "", ss.AccessToken)
+	assert.Equal(t, s.IDToken, ss.IDToken)
 	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
-	assert.NotEqual(t, s.AccessToken, ss.AccessToken)
-	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
+	assert.Equal(t, s.PreferredUsername, ss.PreferredUsername)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, s.Claims, ss.Claims)
+}
+
+func TestDecodeLegacySessionState(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	expires := time.Now().Add(time.Duration(1) * time.Hour)
+	a, _ := c.Encrypt("token1234")
+	r, _ := c.Encrypt("refresh4321")
+	encoded := fmt.Sprintf("email:user@domain.com user:just-user|%s|%d|%s", a, expires.Unix(), r)
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "just-user", ss.User)
+	assert.Equal(t, "user@domain.com", ss.Email)
+	assert.Equal(t, "token1234", ss.AccessToken)
+	assert.Equal(t, expires.Unix(), ss.ExpiresOn.Unix())
+	assert.Equal(t, "refresh4321", ss.RefreshToken)
+}
+
+func TestSessionStateSerializationWithGroupsWithoutTokens(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{User: "mbland", Email: "user@domain.com", Groups: []string{"ops"}}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, strings.Contains(encoded, s.Email))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", ss.User)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, []string{"ops"}, ss.Groups)
 }
 
 func TestSessionStateSerializationNoCipher(t *testing.T) {
@@ -127,6 +181,30 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationWithProvider(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		Provider:    "contractors",
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "contractors", ss.Provider)
+
+	// sessions saved without a cipher keep the provider too
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: provider:contractors", encoded)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user", ss.User)
+	assert.Equal(t, "contractors", ss.Provider)
+}
+
 func TestSessionStateAccountInfo(t *testing.T) {
 	s := &SessionState{
 		Email: "user@domain.com",
@@ -0,0 +1,35 @@
+package sessions
+
+import (
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// CookieSessionStore keeps the whole serialized session in the ticket, so
+// the session lives entirely in the browser's cookie.
+type CookieSessionStore struct {
+	Provider providers.Provider
+	Cipher   *cookie.Cipher
+}
+
+func NewCookieSessionStore(p providers.Provider, c *cookie.Cipher) *CookieSessionStore {
+	return &CookieSessionStore{Provider: p, Cipher: c}
+}
+
+func (s *CookieSessionStore) Save(ticket string, ss *providers.SessionState) (string, error) {
+	return s.Provider.CookieForSession(ss, s.Cipher)
+}
+
+func (s *CookieSessionStore) Load(ticket string) (*providers.SessionState, error) {
+	return s.Provider.SessionFromCookie(ticket, s.Cipher)
+}
+
+// Clear is a no-op; expiring the cookie is enough to forget the session.
+func (s *CookieSessionStore) Clear(ticket string) error {
+	return nil
+}
+
+// Revoke is not supported; the sessions only exist in the browsers.
+func (s *CookieSessionStore) Revoke(sid, sub string) error {
+	return ErrRevokeNotSupported
+}
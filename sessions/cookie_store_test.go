@@ -0,0 +1,33 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieSessionStoreRoundTrip(t *testing.T) {
+	c, err := cookie.NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+	s := NewCookieSessionStore(&providers.ProviderData{}, c)
+
+	session := &providers.SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Hour),
+	}
+	ticket, err := s.Save("", session)
+	assert.Equal(t, nil, err)
+	expected, _ := session.EncodeSessionState(c)
+	assert.Equal(t, len(expected), len(ticket))
+
+	loaded, err := s.Load(ticket)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, session.Email, loaded.Email)
+	assert.Equal(t, session.AccessToken, loaded.AccessToken)
+	assert.Equal(t, nil, s.Clear(ticket))
+	assert.Equal(t, ErrRevokeNotSupported, s.Revoke("", "sub"))
+}
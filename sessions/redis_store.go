@@ -0,0 +1,175 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/go-redis/redis"
+)
+
+// RedisSessionStore keeps sessions in Redis. The ticket handed to the
+// browser is a random id plus a random secret; the id names the Redis key
+// and the secret encrypts the session stored under it, so the contents of
+// Redis alone are not enough to hijack a session.
+//
+// Sessions with "sub" and "sid" claims are also indexed under
+// prefix-sub-<sub> and prefix-sid-<sid>, so they can be revoked.
+type RedisSessionStore struct {
+	Client   *redis.Client
+	Provider providers.Provider
+	Prefix   string
+	Expire   time.Duration
+}
+
+// NewRedisSessionStore connects to the Redis server at url
+// (redis://[:password@]host:port[/db]). Keys are named after prefix and
+// expire after expire.
+func NewRedisSessionStore(url string, prefix string, expire time.Duration, p providers.Provider) (*RedisSessionStore, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse redis url: %s", err)
+	}
+	return &RedisSessionStore{
+		Client:   redis.NewClient(opt),
+		Provider: p,
+		Prefix:   prefix,
+		Expire:   expire,
+	}, nil
+}
+
+func (s *RedisSessionStore) Save(ticket string, ss *providers.SessionState) (string, error) {
+	id, secret, err := parseTicket(ticket)
+	if err != nil {
+		if id, secret, err = newTicket(); err != nil {
+			return "", err
+		}
+	}
+	c, err := cookie.NewCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	value, err := s.Provider.CookieForSession(ss, c)
+	if err != nil {
+		return "", err
+	}
+	pipe := s.Client.TxPipeline()
+	pipe.Set(s.key(id), value, s.Expire)
+	for _, index := range s.indexKeys(ss) {
+		pipe.SAdd(index, id)
+		pipe.Expire(index, s.Expire)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return "", fmt.Errorf("error saving redis session: %s", err)
+	}
+	return formatTicket(id, secret), nil
+}
+
+func (s *RedisSessionStore) Load(ticket string) (*providers.SessionState, error) {
+	id, secret, err := parseTicket(ticket)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.Client.Get(s.key(id)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("session %s not found", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading redis session: %s", err)
+	}
+	c, err := cookie.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return s.Provider.SessionFromCookie(value, c)
+}
+
+func (s *RedisSessionStore) Clear(ticket string) error {
+	id, _, err := parseTicket(ticket)
+	if err != nil {
+		return err
+	}
+	if err := s.Client.Del(s.key(id)).Err(); err != nil {
+		return fmt.Errorf("error clearing redis session: %s", err)
+	}
+	return nil
+}
+
+func (s *RedisSessionStore) Revoke(sid, sub string) error {
+	var index string
+	switch {
+	case sid != "":
+		index = s.indexKey("sid", sid)
+	case sub != "":
+		index = s.indexKey("sub", sub)
+	default:
+		return errors.New("missing sid or sub to revoke sessions of")
+	}
+	ids, err := s.Client.SMembers(index).Result()
+	if err != nil {
+		return fmt.Errorf("error revoking redis sessions: %s", err)
+	}
+	keys := []string{index}
+	for _, id := range ids {
+		keys = append(keys, s.key(id))
+	}
+	if err := s.Client.Del(keys...).Err(); err != nil {
+		return fmt.Errorf("error revoking redis sessions: %s", err)
+	}
+	return nil
+}
+
+func (s *RedisSessionStore) key(id string) string {
+	return fmt.Sprintf("%s-%s", s.Prefix, id)
+}
+
+func (s *RedisSessionStore) indexKey(claim, value string) string {
+	return fmt.Sprintf("%s-%s-%s", s.Prefix, claim, value)
+}
+
+// indexKeys returns the keys of the sets the session is indexed in
+func (s *RedisSessionStore) indexKeys(ss *providers.SessionState) []string {
+	var keys []string
+	for _, claim := range []string{"sub", "sid"} {
+		if value, ok := ss.Claims[claim].(string); ok && value != "" {
+			keys = append(keys, s.indexKey(claim, value))
+		}
+	}
+	return keys
+}
+
+func newTicket() (id string, secret []byte, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	secret = make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	id = hex.EncodeToString(b)
+	return
+}
+
+func formatTicket(id string, secret []byte) string {
+	return fmt.Sprintf("%s.%s", id, base64.RawURLEncoding.EncodeToString(secret))
+}
+
+func parseTicket(ticket string) (id string, secret []byte, err error) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 2 || parts[0] == "" {
+		err = errors.New("invalid session ticket")
+		return
+	}
+	id = parts[0]
+	secret, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		err = fmt.Errorf("invalid session ticket: %s", err)
+	}
+	return
+}
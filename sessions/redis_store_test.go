@@ -0,0 +1,153 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisSessionStore, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start miniredis: %s", err)
+	}
+	s, err := NewRedisSessionStore("redis://"+mr.Addr(), "_oauth2_proxy",
+		time.Hour, &providers.ProviderData{})
+	assert.Equal(t, nil, err)
+	return s, mr
+}
+
+func TestRedisSessionStoreRoundTrip(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	defer mr.Close()
+
+	session := &providers.SessionState{
+		Email:        "user@domain.com",
+		User:         "user",
+		AccessToken:  "token1234",
+		ExpiresOn:    time.Now().Add(time.Hour),
+		RefreshToken: "refresh4321",
+	}
+	ticket, err := s.Save("", session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, strings.Count(ticket, "."))
+
+	// only the ticket id is visible in redis and the tokens are encrypted
+	keys := mr.Keys()
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, "_oauth2_proxy-"+strings.Split(ticket, ".")[0], keys[0])
+	stored, _ := mr.Get(keys[0])
+	assert.Equal(t, false, strings.Contains(stored, "token1234"))
+	assert.Equal(t, time.Hour, mr.TTL(keys[0]))
+
+	loaded, err := s.Load(ticket)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, session.Email, loaded.Email)
+	assert.Equal(t, session.User, loaded.User)
+	assert.Equal(t, session.AccessToken, loaded.AccessToken)
+	assert.Equal(t, session.RefreshToken, loaded.RefreshToken)
+	assert.Equal(t, session.ExpiresOn.Unix(), loaded.ExpiresOn.Unix())
+}
+
+func TestRedisSessionStoreSaveExistingTicket(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	defer mr.Close()
+
+	ticket, err := s.Save("", &providers.SessionState{Email: "user@domain.com", AccessToken: "old"})
+	assert.Equal(t, nil, err)
+	updated, err := s.Save(ticket, &providers.SessionState{Email: "user@domain.com", AccessToken: "new"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ticket, updated)
+	assert.Equal(t, 1, len(mr.Keys()))
+
+	loaded, err := s.Load(ticket)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "new", loaded.AccessToken)
+}
+
+func TestRedisSessionStoreClear(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	defer mr.Close()
+
+	ticket, err := s.Save("", &providers.SessionState{Email: "user@domain.com"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.Clear(ticket))
+	assert.Equal(t, 0, len(mr.Keys()))
+
+	session, err := s.Load(ticket)
+	assert.NotEqual(t, nil, err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+func TestRedisSessionStoreExpired(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	defer mr.Close()
+
+	ticket, err := s.Save("", &providers.SessionState{Email: "user@domain.com"})
+	assert.Equal(t, nil, err)
+	mr.FastForward(2 * time.Hour)
+
+	_, err = s.Load(ticket)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRedisSessionStoreTamperedTicket(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	defer mr.Close()
+
+	ticket, err := s.Save("", &providers.SessionState{Email: "user@domain.com", AccessToken: "token1234"})
+	assert.Equal(t, nil, err)
+
+	// the right id with the wrong secret can't decrypt the tokens
+	id := strings.Split(ticket, ".")[0]
+	other, _ := s.Save("", &providers.SessionState{Email: "other@domain.com"})
+	forged := id + "." + strings.Split(other, ".")[1]
+	loaded, err := s.Load(forged)
+	if err == nil {
+		assert.NotEqual(t, "token1234", loaded.AccessToken)
+	}
+
+	_, err = s.Load("not-a-ticket")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRedisSessionStoreRevoke(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	defer mr.Close()
+
+	save := func(sub, sid string) string {
+		ticket, err := s.Save("", &providers.SessionState{
+			Email:   "user@domain.com",
+			IDToken: "idtoken1234",
+			Claims:  map[string]interface{}{"sub": sub, "sid": sid},
+		})
+		assert.Equal(t, nil, err)
+		return ticket
+	}
+	laptop := save("user1", "session1")
+	phone := save("user1", "session2")
+	other := save("user2", "session3")
+	assert.Equal(t, time.Hour, mr.TTL("_oauth2_proxy-sub-user1"))
+
+	// only the session with the sid
+	assert.Equal(t, nil, s.Revoke("session1", "user1"))
+	_, err := s.Load(laptop)
+	assert.NotEqual(t, nil, err)
+	_, err = s.Load(phone)
+	assert.Equal(t, nil, err)
+
+	// all sessions of the subject
+	assert.Equal(t, nil, s.Revoke("", "user1"))
+	_, err = s.Load(phone)
+	assert.NotEqual(t, nil, err)
+	_, err = s.Load(other)
+	assert.Equal(t, nil, err)
+
+	assert.NotEqual(t, nil, s.Revoke("", ""))
+}
@@ -0,0 +1,26 @@
+package sessions
+
+import (
+	"errors"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// ErrRevokeNotSupported is returned by stores that can't find the sessions
+// of a user, because they don't keep them server side
+var ErrRevokeNotSupported = errors.New("session store does not support revoking sessions")
+
+// SessionStore persists sessions between requests. Each saved session is
+// identified by an opaque ticket which is all the proxy needs to keep in the
+// session cookie.
+type SessionStore interface {
+	// Save stores s and returns the ticket it can be loaded with. A
+	// non-empty ticket from an earlier Save may be passed to update that
+	// session in place.
+	Save(ticket string, s *providers.SessionState) (string, error)
+	Load(ticket string) (*providers.SessionState, error)
+	Clear(ticket string) error
+	// Revoke clears the session with the provider session id sid or, when
+	// sid is empty, all sessions of the provider subject sub.
+	Revoke(sid, sub string) error
+}
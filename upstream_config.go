@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// UpstreamConfig is an upstream of the --upstreams-file, a TOML file of
+// [[upstream]] tables. The pass_* options fall back to the global flags.
+type UpstreamConfig struct {
+	// Host and Path match requests like -virtual-host and -upstream do,
+	// an upstream without a Host serves the hosts without a virtual host
+	Host string `toml:"host"`
+	Path string `toml:"path"`
+	// URL is an http(s):// URL, or a file:// directory served at Path
+	URL string `toml:"url"`
+	// URLs are more http(s):// URLs, the requests are balanced over them
+	// and URL by round_robin or least_conn
+	URLs    []string `toml:"urls"`
+	Balance string   `toml:"balance"`
+
+	// HealthCheckPath is requested every HealthCheckInterval on each URL,
+	// URLs failing MaxFails checks in a row are ejected until a check
+	// passes. URLs that can't be connected to MaxFails times in a row are
+	// ejected for FailTimeout.
+	HealthCheckPath     string   `toml:"health_check_path"`
+	HealthCheckInterval duration `toml:"health_check_interval"`
+	HealthCheckTimeout  duration `toml:"health_check_timeout"`
+	MaxFails            int      `toml:"max_fails"`
+	FailTimeout         duration `toml:"fail_timeout"`
+
+	PassHostHeader  *bool `toml:"pass_host_header"`
+	PassBasicAuth   *bool `toml:"pass_basic_auth"`
+	PassUserHeaders *bool `toml:"pass_user_headers"`
+	PassAccessToken *bool `toml:"pass_access_token"`
+
+	// Timeout limits the wait for the response headers, DialTimeout the
+	// wait for a connection
+	Timeout     duration `toml:"timeout"`
+	DialTimeout duration `toml:"dial_timeout"`
+	// FlushInterval is how often streamed responses are flushed to the
+	// client, they are buffered without it
+	FlushInterval duration `toml:"flush_interval"`
+
+	TLSInsecureSkipVerify bool   `toml:"tls_insecure_skip_verify"`
+	TLSCAFile             string `toml:"tls_ca_file"`
+	TLSServerName         string `toml:"tls_server_name"`
+
+	// Headers are set on the requests to the upstream
+	Headers map[string]string `toml:"headers"`
+
+	// SkipAuth serves the upstream without signing in. Otherwise the
+	// upstream is restricted to users with one of the AllowedEmails, an
+	// email in one of the AllowedDomains or one of the AllowedGroups, if
+	// there are any.
+	SkipAuth       bool     `toml:"skip_auth"`
+	AllowedEmails  []string `toml:"allowed_emails"`
+	AllowedDomains []string `toml:"allowed_domains"`
+	AllowedGroups  []string `toml:"allowed_groups"`
+
+	url       *url.URL
+	urls      []*url.URL
+	rule      *AccessRule
+	transport *http.Transport
+}
+
+// duration is a time.Duration read from a TOML string, ie: "30s"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+// loadUpstreamsFile reads and validates the [[upstream]] tables of the file
+func loadUpstreamsFile(path string) ([]*UpstreamConfig, error) {
+	var file struct {
+		Upstreams []*UpstreamConfig `toml:"upstream"`
+	}
+	md, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return nil, fmt.Errorf("unknown option %q", undecoded[0].String())
+	}
+	for i, c := range file.Upstreams {
+		if err := c.parse(); err != nil {
+			return nil, fmt.Errorf("upstream %d: %s", i+1, err)
+		}
+	}
+	return file.Upstreams, nil
+}
+
+func (c *UpstreamConfig) parse() error {
+	urls := c.URLs
+	if c.URL != "" {
+		urls = append([]string{c.URL}, urls...)
+	}
+	if len(urls) == 0 {
+		return errors.New("missing url")
+	}
+	for _, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return fmt.Errorf("error parsing url: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+			return fmt.Errorf("unknown upstream protocol %q", u.Scheme)
+		}
+		if u.Scheme == "file" && len(urls) > 1 {
+			return errors.New("file:// urls can't be balanced")
+		}
+		c.urls = append(c.urls, u)
+	}
+	c.url = c.urls[0]
+	switch c.Balance {
+	case "":
+		c.Balance = "round_robin"
+	case "round_robin", "least_conn":
+	default:
+		return fmt.Errorf("unknown balance %q, expected round_robin or least_conn", c.Balance)
+	}
+	c.Host = strings.ToLower(c.Host)
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	c.rule = &AccessRule{
+		Emails:  c.AllowedEmails,
+		Domains: c.AllowedDomains,
+		Groups:  c.AllowedGroups,
+	}
+	if c.url.Scheme == "file" {
+		return nil
+	}
+	if c.HealthCheckPath != "" && !strings.HasPrefix(c.HealthCheckPath, "/") {
+		return fmt.Errorf("health_check_path %q doesn't start with /", c.HealthCheckPath)
+	}
+	if c.HealthCheckInterval.Duration <= 0 {
+		c.HealthCheckInterval.Duration = 10 * time.Second
+	}
+	if c.HealthCheckTimeout.Duration <= 0 {
+		c.HealthCheckTimeout.Duration = 5 * time.Second
+	}
+	if c.MaxFails <= 0 {
+		c.MaxFails = 1
+	}
+	if c.FailTimeout.Duration <= 0 {
+		c.FailTimeout.Duration = 30 * time.Second
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+		ServerName:         c.TLSServerName,
+	}
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in tls_ca_file %s", c.TLSCAFile)
+		}
+	}
+	dialTimeout := 30 * time.Second
+	if c.DialTimeout.Duration > 0 {
+		dialTimeout = c.DialTimeout.Duration
+	}
+	// like http.DefaultTransport
+	c.transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: c.Timeout.Duration,
+		TLSClientConfig:       tlsConfig,
+	}
+	return nil
+}
+
+// boolOption returns the upstream's option if it's set, and the global one
+// otherwise
+func boolOption(option *bool, global bool) bool {
+	if option == nil {
+		return global
+	}
+	return *option
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeUpstreamsFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(contents)
+	return f.Name()
+}
+
+func TestLoadUpstreamsFile(t *testing.T) {
+	path := writeUpstreamsFile(t, `
+[[upstream]]
+url = "http://127.0.0.1:3000/"
+host = "Grafana.example.com"
+pass_host_header = false
+pass_access_token = true
+timeout = "10s"
+dial_timeout = "2s"
+tls_server_name = "grafana.internal"
+skip_auth = false
+allowed_groups = ["ops"]
+  [upstream.headers]
+  X-WEBAUTH-ORG = "example"
+
+[[upstream]]
+path = "/static/"
+url = "file:///var/www/static/"
+skip_auth = true
+`)
+	defer os.Remove(path)
+
+	configs, err := loadUpstreamsFile(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(configs))
+
+	c := configs[0]
+	assert.Equal(t, "grafana.example.com", c.Host)
+	assert.Equal(t, "/", c.Path)
+	assert.Equal(t, false, boolOption(c.PassHostHeader, true))
+	assert.Equal(t, true, boolOption(c.PassAccessToken, false))
+	assert.Equal(t, true, boolOption(c.PassUserHeaders, true))
+	assert.Equal(t, 10*time.Second, c.transport.ResponseHeaderTimeout)
+	assert.Equal(t, "grafana.internal", c.transport.TLSClientConfig.ServerName)
+	assert.Equal(t, map[string]string{"X-WEBAUTH-ORG": "example"}, c.Headers)
+	assert.Equal(t, []string{"ops"}, c.rule.Groups)
+
+	c = configs[1]
+	assert.Equal(t, "/static/", c.Path)
+	assert.Equal(t, "/var/www/static/", c.url.Path)
+	assert.Equal(t, true, c.SkipAuth)
+}
+
+func TestLoadUpstreamsFileErrors(t *testing.T) {
+	for contents, expected := range map[string]string{
+		"[[upstream]]\npath = \"/\"":                                                      "upstream 1: missing url",
+		"[[upstream]]\nurl = \"ftp://127.0.0.1/\"":                                        "upstream 1: unknown upstream protocol \"ftp\"",
+		"[[upstream]]\nurl = \"http://127.0.0.1/\"\npass_headers = true":                  "unknown option \"upstream.pass_headers\"",
+		"[[upstream]]\nurl = \"http://127.0.0.1/\"\ntimeout = \"soon\"":                   "invalid duration",
+		"[[upstream]]\nurl = \"http://127.0.0.1/\"\ntls_ca_file = \"" + os.DevNull + "\"": "upstream 1: no certificates in tls_ca_file " + os.DevNull,
+		"[[upstream]]\nurls = [\"http://127.0.0.1/\"]\nbalance = \"random\"":              "upstream 1: unknown balance \"random\"",
+		"[[upstream]]\nurl = \"file:///var/www/\"\nurls = [\"http://127.0.0.1/\"]":        "upstream 1: file:// urls can't be balanced",
+	} {
+		path := writeUpstreamsFile(t, contents)
+		_, err := loadUpstreamsFile(path)
+		os.Remove(path)
+		if assert.NotEqual(t, nil, err, contents) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+}
+
+func TestProxyWithUpstreamsFile(t *testing.T) {
+	// the headers of the last request to the upstream, the slow request's
+	// handler outlives its proxy request
+	var mu sync.Mutex
+	var upstreamHeader http.Header
+	lastHeader := func() http.Header {
+		mu.Lock()
+		defer mu.Unlock()
+		return upstreamHeader
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := make(http.Header)
+		for name, values := range r.Header {
+			header[name] = values
+		}
+		mu.Lock()
+		upstreamHeader = header
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("upstream " + r.Host + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	path := writeUpstreamsFile(t, `
+[[upstream]]
+url = "`+upstream.URL+`"
+pass_user_headers = false
+pass_basic_auth = false
+timeout = "50ms"
+  [upstream.headers]
+  X-Injected = "yes"
+
+[[upstream]]
+path = "/public/"
+url = "`+upstream.URL+`"
+skip_auth = true
+
+[[upstream]]
+path = "/admin/"
+url = "`+upstream.URL+`"
+pass_host_header = false
+allowed_groups = ["ops"]
+
+[[upstream]]
+host = "grafana.corp"
+url = "`+upstream.URL+`/grafana"
+pass_user_headers = true
+`)
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.UpstreamsFile = path
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.CookieRefresh = time.Hour
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(providerURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	serve := func(host, path string, session *providers.SessionState) *httptest.ResponseRecorder {
+		mu.Lock()
+		upstreamHeader = nil
+		mu.Unlock()
+		req, _ := http.NewRequest("GET", "http://"+host+path, nil)
+		if session != nil {
+			value, _ := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	user := &providers.SessionState{Email: "michael.bland@gsa.gov"}
+
+	rw := serve("proxy.corp", "/", user)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream proxy.corp/", rw.Body.String())
+	assert.Equal(t, "yes", lastHeader().Get("X-Injected"))
+	assert.Equal(t, "", lastHeader().Get("X-Forwarded-User"))
+	assert.Equal(t, "", lastHeader().Get("Authorization"))
+
+	// the upstream took longer than its timeout
+	rw = serve("proxy.corp", "/slow", user)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	rw = serve("proxy.corp", "/", nil)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	rw = serve("proxy.corp", "/public/index.html", nil)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream proxy.corp/public/index.html", rw.Body.String())
+
+	rw = serve("proxy.corp", "/admin/users", user)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, http.Header(nil), lastHeader())
+	rw = serve("proxy.corp", "/admin/users", &providers.SessionState{
+		Email: "michael.bland@gsa.gov", Groups: []string{"ops"}})
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream "+providerURL.Host+"/admin/users", rw.Body.String())
+
+	rw = serve("grafana.corp", "/dashboards", user)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream grafana.corp/dashboards", rw.Body.String())
+	assert.Equal(t, "michael.bland", lastHeader().Get("X-Forwarded-User"))
+	assert.Equal(t, "", lastHeader().Get("X-Injected"))
+}
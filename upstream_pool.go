@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// upstreamPool balances the requests for an upstream of the
+// --upstreams-file over its backends. Backends are ejected from the pool
+// after max_fails failed health checks in a row, until a check passes, or
+// after max_fails connection errors in a row, for fail_timeout.
+type upstreamPool struct {
+	config   *UpstreamConfig
+	backends []*upstreamBackend
+	client   *http.Client
+
+	mu sync.Mutex
+	// next is the backend the search for the next request starts at
+	next int
+
+	// closing stopping stops the health checks, which closes stopped
+	stopping chan struct{}
+	stopped  chan struct{}
+}
+
+type upstreamBackend struct {
+	url     *url.URL
+	handler http.Handler
+
+	// guarded by the pool's mu
+	active       int
+	fails        int
+	ejectedUntil time.Time
+	checkFails   int
+	unhealthy    bool
+}
+
+// upstreamPoolStatus is the status of a pool as served at /oauth2/upstreams
+type upstreamPoolStatus struct {
+	Host     string                  `json:"host"`
+	Path     string                  `json:"path"`
+	Balance  string                  `json:"balance"`
+	Backends []upstreamBackendStatus `json:"backends"`
+}
+
+type upstreamBackendStatus struct {
+	URL            string     `json:"url"`
+	Available      bool       `json:"available"`
+	Healthy        bool       `json:"healthy"`
+	EjectedUntil   *time.Time `json:"ejected_until,omitempty"`
+	ActiveRequests int        `json:"active_requests"`
+	Fails          int        `json:"fails"`
+}
+
+// newUpstreamPool returns a pool of reverse proxies to the http(s) urls of
+// the upstream, and starts its health checks if it has a health_check_path
+func newUpstreamPool(c *UpstreamConfig, passHostHeader bool) *upstreamPool {
+	p := &upstreamPool{
+		config: c,
+		client: &http.Client{
+			Transport: c.transport,
+			Timeout:   c.HealthCheckTimeout.Duration,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, u := range c.urls {
+		target := *u
+		target.Path = ""
+		b := &upstreamBackend{url: &target}
+		proxy := NewReverseProxy(&target)
+		if !passHostHeader {
+			setProxyUpstreamHostHeader(proxy, &target)
+		} else {
+			setProxyDirector(proxy)
+		}
+		proxy.Transport = &backendTransport{p, b, c.transport}
+		proxy.FlushInterval = c.FlushInterval.Duration
+		ws := newWebSocketProxy(&target, passHostHeader, proxy)
+		ws.tlsConfig = c.transport.TLSClientConfig
+		ws.dial = func(network, addr string) (net.Conn, error) {
+			conn, err := c.transport.DialContext(context.Background(), network, addr)
+			p.reportConnection(b, err)
+			return conn, err
+		}
+		b.handler = ws
+		p.backends = append(p.backends, b)
+	}
+	if c.HealthCheckPath != "" {
+		go p.run()
+	} else {
+		close(p.stopped)
+	}
+	return p
+}
+
+// stop ends the health checks of the pool
+func (p *upstreamPool) stop() {
+	close(p.stopping)
+	<-p.stopped
+}
+
+func (p *upstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := p.pick()
+	if b == nil {
+		http.Error(w, "no available upstream", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.done(b)
+	w.Header().Set("GAP-Upstream-Address", b.url.Host)
+	b.handler.ServeHTTP(w, r)
+}
+
+func (b *upstreamBackend) available(now time.Time) bool {
+	return !b.unhealthy && !now.Before(b.ejectedUntil)
+}
+
+// pick returns the available backend to send a request to, the next one in
+// turn or, balancing by least_conn, the one with the fewest requests in
+// flight, and nil when every backend is ejected
+func (p *upstreamPool) pick() *upstreamBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	picked := -1
+	for i := range p.backends {
+		j := (p.next + i) % len(p.backends)
+		b := p.backends[j]
+		if !b.available(now) {
+			continue
+		}
+		if picked == -1 || b.active < p.backends[picked].active {
+			picked = j
+		}
+		if p.config.Balance != "least_conn" {
+			break
+		}
+	}
+	if picked == -1 {
+		return nil
+	}
+	p.next = (picked + 1) % len(p.backends)
+	b := p.backends[picked]
+	b.active++
+	return b
+}
+
+func (p *upstreamPool) done(b *upstreamBackend) {
+	p.mu.Lock()
+	b.active--
+	p.mu.Unlock()
+}
+
+// backendTransport tells the pool whether the backend could be connected to
+type backendTransport struct {
+	pool      *upstreamPool
+	backend   *upstreamBackend
+	transport http.RoundTripper
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	t.pool.reportConnection(t.backend, err)
+	return resp, err
+}
+
+// reportConnection ejects the backend for fail_timeout after max_fails
+// connection errors in a row. Other errors, ie: timeouts waiting for the
+// response, don't count.
+func (p *upstreamPool) reportConnection(b *upstreamBackend, err error) {
+	if err != nil && !isConnectionError(err) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		b.fails = 0
+		return
+	}
+	b.fails++
+	if b.fails >= p.config.MaxFails {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(p.config.FailTimeout.Duration)
+		log.Printf("ejecting upstream %s for %s: %s", b.url, p.config.FailTimeout.Duration, err)
+	}
+}
+
+func isConnectionError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+func (p *upstreamPool) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.config.HealthCheckInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+		case <-p.stopping:
+			return
+		}
+	}
+}
+
+// check requests the health_check_path of every backend, a 2xx or 3xx
+// response passes
+func (p *upstreamPool) check() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *upstreamBackend) {
+			defer wg.Done()
+			p.reportCheck(b, p.checkBackend(b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (p *upstreamPool) checkBackend(b *upstreamBackend) error {
+	u := *b.url
+	u.Path = p.config.HealthCheckPath
+	resp, err := p.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *upstreamPool) reportCheck(b *upstreamBackend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		if b.unhealthy {
+			log.Printf("upstream %s passed its health check, restoring it", b.url)
+		}
+		b.checkFails = 0
+		b.unhealthy = false
+		return
+	}
+	b.checkFails++
+	if !b.unhealthy && b.checkFails >= p.config.MaxFails {
+		b.unhealthy = true
+		log.Printf("ejecting upstream %s: %s", b.url, err)
+	}
+}
+
+// request returns a request for the pool's host and path, to check the
+// access rules against
+func (p *upstreamPool) request() *http.Request {
+	path := p.config.Path
+	if path == "" {
+		path = "/"
+	}
+	return &http.Request{
+		Method: "GET",
+		Host:   p.config.Host,
+		URL:    &url.URL{Path: path},
+		Header: make(http.Header),
+	}
+}
+
+func (p *upstreamPool) status() upstreamPoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	s := upstreamPoolStatus{
+		Host:    p.config.Host,
+		Path:    p.config.Path,
+		Balance: p.config.Balance,
+	}
+	for _, b := range p.backends {
+		bs := upstreamBackendStatus{
+			URL:            b.url.String(),
+			Available:      b.available(now),
+			Healthy:        !b.unhealthy,
+			ActiveRequests: b.active,
+			Fails:          b.fails + b.checkFails,
+		}
+		if now.Before(b.ejectedUntil) {
+			ejectedUntil := b.ejectedUntil
+			bs.EjectedUntil = &ejectedUntil
+		}
+		s.Backends = append(s.Backends, bs)
+	}
+	return s
+}
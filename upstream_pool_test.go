@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBackend(name string, healthy *bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && healthy != nil && !*healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+}
+
+func newTestUpstreamPool(t *testing.T, contents string) *upstreamPool {
+	path := writeUpstreamsFile(t, contents)
+	defer os.Remove(path)
+	configs, err := loadUpstreamsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newUpstreamPool(configs[0], true)
+}
+
+func servePool(p *upstreamPool) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "http://proxy.corp/", nil)
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	return rw
+}
+
+// closedURL returns the URL of a port nothing listens on
+func closedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	a, b := newTestBackend("a", nil), newTestBackend("b", nil)
+	defer a.Close()
+	defer b.Close()
+	p := newTestUpstreamPool(t, "[[upstream]]\nurls = [\""+a.URL+"\", \""+b.URL+"\"]")
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		rw := servePool(p)
+		assert.Equal(t, 200, rw.Code)
+		bodies = append(bodies, rw.Body.String())
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, bodies)
+	assert.Equal(t, p.backends[0].url.Host, servePool(p).Header().Get("GAP-Upstream-Address"))
+}
+
+func TestUpstreamPoolLeastConn(t *testing.T) {
+	p := newTestUpstreamPool(t, `
+[[upstream]]
+urls = ["http://127.0.0.1:3000/", "http://127.0.0.1:3001/", "http://127.0.0.1:3002/"]
+balance = "least_conn"
+`)
+	first := p.pick()
+	second := p.pick()
+	assert.NotEqual(t, first, second)
+	p.done(first)
+	// the first backend and the third are idle, the search goes on from
+	// the third
+	assert.Equal(t, p.backends[2], p.pick())
+	assert.Equal(t, first, p.pick())
+	assert.Equal(t, 1, first.active)
+}
+
+func TestUpstreamPoolEjectsUnreachableBackends(t *testing.T) {
+	a := newTestBackend("a", nil)
+	defer a.Close()
+	p := newTestUpstreamPool(t, `
+[[upstream]]
+urls = ["`+closedURL(t)+`", "`+a.URL+`"]
+max_fails = 2
+fail_timeout = "1h"
+`)
+
+	// the first connection error doesn't eject the backend yet
+	assert.Equal(t, http.StatusBadGateway, servePool(p).Code)
+	assert.Equal(t, "a", servePool(p).Body.String())
+	assert.Equal(t, 1, p.status().Backends[0].Fails)
+	assert.Equal(t, http.StatusBadGateway, servePool(p).Code)
+
+	status := p.status()
+	assert.Equal(t, false, status.Backends[0].Available)
+	assert.Equal(t, true, status.Backends[0].Healthy)
+	assert.NotEqual(t, (*time.Time)(nil), status.Backends[0].EjectedUntil)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "a", servePool(p).Body.String())
+	}
+
+	// a timeout waiting for the response is not a connection error
+	p.reportConnection(p.backends[1], errors.New("net/http: timeout awaiting response headers"))
+	assert.Equal(t, true, p.status().Backends[1].Available)
+}
+
+func TestUpstreamPoolHealthChecks(t *testing.T) {
+	healthy := true
+	a, b := newTestBackend("a", &healthy), newTestBackend("b", nil)
+	defer a.Close()
+	defer b.Close()
+	p := newTestUpstreamPool(t, `
+[[upstream]]
+urls = ["`+a.URL+`", "`+b.URL+`"]
+health_check_path = "/health"
+health_check_interval = "1h"
+`)
+	defer p.stop()
+
+	healthy = false
+	p.check()
+	status := p.status()
+	assert.Equal(t, false, status.Backends[0].Healthy)
+	assert.Equal(t, false, status.Backends[0].Available)
+	assert.Equal(t, true, status.Backends[1].Available)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "b", servePool(p).Body.String())
+	}
+
+	b.Close()
+	p.check()
+	assert.Equal(t, http.StatusServiceUnavailable, servePool(p).Code)
+
+	healthy = true
+	p.check()
+	assert.Equal(t, true, p.status().Backends[0].Available)
+	assert.Equal(t, "a", servePool(p).Body.String())
+}
+
+func TestUpstreamPoolStop(t *testing.T) {
+	checks := 0
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks++
+	}))
+	defer a.Close()
+	p := newTestUpstreamPool(t, `
+[[upstream]]
+urls = ["`+a.URL+`"]
+health_check_path = "/health"
+health_check_interval = "10ms"
+`)
+	p.stop()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, checks)
+}
+
+func TestUpstreamsStatus(t *testing.T) {
+	a := newTestBackend("a", nil)
+	defer a.Close()
+	path := writeUpstreamsFile(t, `
+[[upstream]]
+path = "/app/"
+urls = ["`+a.URL+`", "`+closedURL(t)+`"]
+balance = "least_conn"
+
+[[upstream]]
+path = "/ops/"
+urls = ["`+a.URL+`"]
+allowed_groups = ["ops"]
+
+[[upstream]]
+path = "/billing/"
+urls = ["`+a.URL+`"]
+`)
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.UpstreamsFile = path
+	opts.AccessRules = []string{"path=^/billing/&group=finance"}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(a.URL)
+	opts.provider = NewTestProvider(providerURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "http://proxy.corp/oauth2/upstreams", nil)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	value, _ := proxy.provider.CookieForSession(&providers.SessionState{Email: "michael.bland@gsa.gov"}, proxy.CookieCipher)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	var pools []upstreamPoolStatus
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &pools))
+	assert.Equal(t, 1, len(pools))
+	assert.Equal(t, "/app/", pools[0].Path)
+	assert.Equal(t, "least_conn", pools[0].Balance)
+	assert.Equal(t, 2, len(pools[0].Backends))
+	assert.Equal(t, a.URL, pools[0].Backends[0].URL)
+	assert.Equal(t, true, pools[0].Backends[0].Available)
+
+	// only the upstreams the user may reach are listed
+	value, _ = proxy.provider.CookieForSession(&providers.SessionState{
+		Email: "michael.bland@gsa.gov", Groups: []string{"ops", "finance"}}, proxy.CookieCipher)
+	req, _ = http.NewRequest("GET", "http://proxy.corp/oauth2/upstreams", nil)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	pools = nil
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &pools))
+	assert.Equal(t, 3, len(pools))
+}
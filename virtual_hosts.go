@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// VirtualHost routes the requests for its Host to its own Upstreams, by
+// path like the --upstream flags, for the users its Rule allows
+type VirtualHost struct {
+	// Host is a host name, or "*." followed by a domain to match any host
+	// below that domain, see matchHost
+	Host      string
+	Upstreams []*url.URL
+	// Rule holds the emails, domains and groups the host is restricted to
+	Rule *AccessRule
+
+	mux *http.ServeMux
+}
+
+// parseVirtualHost parses a virtual host given as URL query parameters, ie:
+// "host=grafana.example.com&upstream=http://127.0.0.1:3000/&group=ops"
+func parseVirtualHost(spec string) (*VirtualHost, error) {
+	params, err := url.ParseQuery(spec)
+	if err != nil {
+		return nil, err
+	}
+	vh := &VirtualHost{Rule: &AccessRule{}}
+	for name, values := range params {
+		switch name {
+		case "host":
+			vh.Host = strings.ToLower(values[0])
+		case "upstream":
+			for _, u := range values {
+				upstreamURL, err := url.Parse(u)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing upstream: %s", err)
+				}
+				if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" && upstreamURL.Scheme != "file" {
+					return nil, fmt.Errorf("unknown upstream protocol %q", upstreamURL.Scheme)
+				}
+				if upstreamURL.Path == "" {
+					upstreamURL.Path = "/"
+				}
+				vh.Upstreams = append(vh.Upstreams, upstreamURL)
+			}
+		case "email":
+			vh.Rule.Emails = append(vh.Rule.Emails, values...)
+		case "domain":
+			for _, domain := range values {
+				vh.Rule.Domains = append(vh.Rule.Domains, strings.TrimPrefix(domain, "@"))
+			}
+		case "group":
+			vh.Rule.Groups = append(vh.Rule.Groups, values...)
+		default:
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	if vh.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	if len(vh.Upstreams) == 0 {
+		return nil, errors.New("missing upstream")
+	}
+	vh.Rule.Host = vh.Host
+	return vh, nil
+}
+
+// sortVirtualHosts orders the hosts the way they are matched: host names
+// before wildcards, and longer wildcards before shorter ones
+func sortVirtualHosts(hosts []*VirtualHost) {
+	sort.SliceStable(hosts, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(hosts[i].Host, "*."), strings.HasPrefix(hosts[j].Host, "*.")
+		if wi != wj {
+			return wj
+		}
+		return wi && len(hosts[i].Host) > len(hosts[j].Host)
+	})
+}
+
+// findVirtualHost returns the virtual host for the host pattern, if there
+// is one
+func findVirtualHost(hosts []*VirtualHost, host string) *VirtualHost {
+	for _, vh := range hosts {
+		if vh.Host == host {
+			return vh
+		}
+	}
+	return nil
+}
+
+// matchVirtualHost returns the first of the sorted hosts matching the
+// request's host, if any does
+func matchVirtualHost(hosts []*VirtualHost, req *http.Request) *VirtualHost {
+	for _, vh := range hosts {
+		if matchHost(vh.Host, req.Host) {
+			return vh
+		}
+	}
+	return nil
+}
+
+// virtualHostMux serves requests with the upstreams of their virtual host,
+// and requests for other hosts with the fallback, the --upstream flags
+type virtualHostMux struct {
+	hosts    []*VirtualHost
+	fallback *http.ServeMux
+}
+
+func (m *virtualHostMux) serveMux(req *http.Request) *http.ServeMux {
+	if vh := matchVirtualHost(m.hosts, req); vh != nil {
+		return vh.mux
+	}
+	return m.fallback
+}
+
+// upstream returns the upstream serving the request, if any
+func (m *virtualHostMux) upstream(req *http.Request) *UpstreamProxy {
+	h, _ := m.serveMux(req).Handler(req)
+	u, _ := h.(*UpstreamProxy)
+	return u
+}
+
+func (m *virtualHostMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	m.serveMux(req).ServeHTTP(rw, req)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVirtualHost(t *testing.T) {
+	vh, err := parseVirtualHost("host=Grafana.example.com&upstream=http://127.0.0.1:3000" +
+		"&upstream=file:///var/www/static%23/static/&domain=example.com&group=ops")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "grafana.example.com", vh.Host)
+	assert.Equal(t, 2, len(vh.Upstreams))
+	assert.Equal(t, "http://127.0.0.1:3000/", vh.Upstreams[0].String())
+	assert.Equal(t, "/static/", vh.Upstreams[1].Fragment)
+	assert.Equal(t, "grafana.example.com", vh.Rule.Host)
+	assert.Equal(t, []string{"example.com"}, vh.Rule.Domains)
+	assert.Equal(t, []string{"ops"}, vh.Rule.Groups)
+
+	for spec, expected := range map[string]string{
+		"upstream=http://127.0.0.1:3000/":                     "missing host",
+		"host=grafana.example.com":                            "missing upstream",
+		"host=grafana.example.com&upstream=ftp://127.0.0.1/":  "unknown upstream protocol \"ftp\"",
+		"host=grafana.example.com&upstream=http://a/&path=/x": "unknown parameter \"path\"",
+	} {
+		_, err := parseVirtualHost(spec)
+		assert.Equal(t, expected, err.Error(), spec)
+	}
+	_, err = parseVirtualHost("host=grafana.example.com&upstream=127.0.0.1:3000")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestMatchVirtualHost(t *testing.T) {
+	var hosts []*VirtualHost
+	for _, host := range []string{"*.example.com", "*.corp.example.com", "grafana.corp.example.com"} {
+		hosts = append(hosts, &VirtualHost{Host: host})
+	}
+	sortVirtualHosts(hosts)
+	assert.Equal(t, "grafana.corp.example.com", hosts[0].Host)
+	assert.Equal(t, "*.corp.example.com", hosts[1].Host)
+	assert.Equal(t, "*.example.com", hosts[2].Host)
+
+	for host, expected := range map[string]string{
+		"grafana.corp.example.com":      "grafana.corp.example.com",
+		"grafana.corp.example.com:4180": "grafana.corp.example.com",
+		"kibana.corp.example.com":       "*.corp.example.com",
+		"www.example.com":               "*.example.com",
+		"example.com":                   "",
+		"example.org":                   "",
+	} {
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		matched := ""
+		if vh := matchVirtualHost(hosts, req); vh != nil {
+			matched = vh.Host
+		}
+		assert.Equal(t, expected, matched, host)
+	}
+}
+
+func TestProxyRoutesVirtualHosts(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	fallback, grafana, kibana := newUpstream("fallback"), newUpstream("grafana"), newUpstream("kibana")
+	defer fallback.Close()
+	defer grafana.Close()
+	defer kibana.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, fallback.URL)
+	opts.VirtualHosts = []string{
+		"host=*.kibana.corp&upstream=" + kibana.URL + "/&group=ops",
+		"host=grafana.corp&upstream=" + grafana.URL + "/",
+	}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	// a cookie cipher, so the groups are saved in the session
+	opts.CookieRefresh = time.Hour
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(fallback.URL)
+	opts.provider = NewTestProvider(providerURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	serve := func(host, path string, groups ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://"+host+path, nil)
+		value, _ := proxy.provider.CookieForSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", Groups: groups}, proxy.CookieCipher)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve("grafana.corp", "/dashboards")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "grafana /dashboards", rw.Body.String())
+
+	rw = serve("proxy.corp", "/dashboards")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "fallback /dashboards", rw.Body.String())
+
+	rw = serve("logs.kibana.corp", "/app", "ops")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "kibana /app", rw.Body.String())
+
+	// the kibana hosts are restricted to ops
+	rw = serve("logs.kibana.corp", "/app", "users")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
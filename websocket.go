@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webSocketProxy tunnels WebSocket connections to the target, and serves the
+// other requests with the handler, the reverse proxy to the target
+type webSocketProxy struct {
+	target         *url.URL
+	passHostHeader bool
+	handler        http.Handler
+	// tlsConfig is used for https targets, dial connects to the target
+	tlsConfig *tls.Config
+	dial      func(network, addr string) (net.Conn, error)
+}
+
+func newWebSocketProxy(target *url.URL, passHostHeader bool, handler http.Handler) *webSocketProxy {
+	return &webSocketProxy{
+		target:         target,
+		passHostHeader: passHostHeader,
+		handler:        handler,
+		dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+	}
+}
+
+// isWebSocketRequest returns whether the request asks to upgrade the
+// connection to a WebSocket
+func isWebSocketRequest(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *webSocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !isWebSocketRequest(req) {
+		p.handler.ServeHTTP(rw, req)
+		return
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "websockets are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backend, err := p.dialTarget()
+	if err != nil {
+		log.Printf("websocket upstream %s error: %s", p.target.Host, err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	outreq := new(http.Request)
+	*outreq = *req
+	outreq.Header = make(http.Header)
+	for name, values := range req.Header {
+		outreq.Header[name] = values
+	}
+	// use RequestURI so that we aren't unescaping encoded slashes in the request path
+	outreq.URL = &url.URL{Opaque: req.RequestURI}
+	if !p.passHostHeader {
+		outreq.Host = p.target.Host
+	}
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := outreq.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	if err := outreq.Write(backend); err != nil {
+		log.Printf("websocket upstream %s error: %s", p.target.Host, err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Printf("error hijacking websocket connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// the upstream's response, 101 Switching Protocols or not, goes to
+	// the client as is, and the tunnel lasts until either side closes it
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *webSocketProxy) dialTarget() (net.Conn, error) {
+	port := p.target.Port()
+	if port == "" {
+		port = "80"
+		if p.target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := p.dial("tcp", net.JoinHostPort(p.target.Hostname(), port))
+	if err != nil || p.target.Scheme != "https" {
+		return conn, err
+	}
+	tlsConfig := &tls.Config{}
+	if p.tlsConfig != nil {
+		tlsConfig = p.tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = p.target.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsWebSocketRequest(t *testing.T) {
+	for _, tc := range []struct {
+		upgrade, connection string
+		expected            bool
+	}{
+		{"websocket", "Upgrade", true},
+		{"WebSocket", "keep-alive, upgrade", true},
+		{"websocket", "keep-alive", false},
+		{"h2c", "Upgrade", false},
+		{"", "", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://proxy.corp/socket", nil)
+		req.Header.Set("Upgrade", tc.upgrade)
+		req.Header.Set("Connection", tc.connection)
+		assert.Equal(t, tc.expected, isWebSocketRequest(req), tc.upgrade+" "+tc.connection)
+	}
+}
+
+// newEchoWebSocketServer upgrades the connection and echoes the lines it
+// reads, prefixed with the Host and X-Forwarded-User of the upgrade request
+func newEchoWebSocketServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketRequest(r) {
+			w.Write([]byte("not a websocket"))
+			return
+		}
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString(r.Host + " " + r.Header.Get("X-Forwarded-User") + " " + r.URL.RequestURI() + " " + line)
+			buf.Flush()
+		}
+	}))
+}
+
+func newStreamingTestProxy(t *testing.T, opts *Options, upstreamURL string, logs io.Writer) *httptest.Server {
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	providerURL, _ := url.Parse(upstreamURL)
+	opts.provider = NewTestProvider(providerURL, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	return httptest.NewServer(LoggingHandler(logs, proxy, true, "{{.Upstream}} {{.RequestURI}} {{.StatusCode}}"))
+}
+
+func sessionCookie(t *testing.T, server *httptest.Server) string {
+	proxy := server.Config.Handler.(loggingHandler).handler.(*OAuthProxy)
+	value, err := proxy.provider.CookieForSession(&providers.SessionState{Email: "michael.bland@gsa.gov"}, proxy.CookieCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	return proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()).String()
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, path, cookie string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: proxy.corp\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nCookie: "+cookie+"\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+// syncBuffer is a buffer the request log can be read from while the
+// handler of a tunneled connection may still be writing to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProxyTunnelsWebSockets(t *testing.T) {
+	upstream := newEchoWebSocketServer()
+	defer upstream.Close()
+	logs := &syncBuffer{}
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	server := newStreamingTestProxy(t, opts, upstream.URL, logs)
+	defer server.Close()
+
+	conn, _, resp := dialWebSocket(t, server, "/socket?room=a%2Fb", "")
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, reader, resp := dialWebSocket(t, server, "/socket?room=a%2Fb", sessionCookie(t, server))
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	io.WriteString(conn, "hello\n")
+	line, err := reader.ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "proxy.corp michael.bland /socket?room=a%2Fb hello\n", line)
+	io.WriteString(conn, "again\n")
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "proxy.corp michael.bland /socket?room=a%2Fb again\n", line)
+	conn.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	for i := 0; i < 100 && !strings.Contains(logs.String(), "101"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Contains(t, logs.String(), upstreamURL.Host+" \"/socket?room=a%2Fb\" 101")
+}
+
+func TestProxyTunnelsWebSocketsWithUpstreamsFile(t *testing.T) {
+	upstream := newEchoWebSocketServer()
+	defer upstream.Close()
+	path := writeUpstreamsFile(t, `
+[[upstream]]
+urls = ["`+closedURL(t)+`", "`+upstream.URL+`"]
+pass_host_header = false
+`)
+	defer os.Remove(path)
+	opts := NewOptions()
+	opts.UpstreamsFile = path
+	server := newStreamingTestProxy(t, opts, upstream.URL, &bytes.Buffer{})
+	defer server.Close()
+	cookie := sessionCookie(t, server)
+
+	// the first backend can't be connected to, and is ejected
+	conn, _, resp := dialWebSocket(t, server, "/socket", cookie)
+	conn.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	conn, reader, resp := dialWebSocket(t, server, "/socket", cookie)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	io.WriteString(conn, "hello\n")
+	line, _ := reader.ReadString('\n')
+	upstreamURL, _ := url.Parse(upstream.URL)
+	assert.Equal(t, upstreamURL.Host+" michael.bland /socket hello\n", line)
+}
+
+func TestProxyFlushesStreamedResponses(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: last\n\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+	path := writeUpstreamsFile(t, `
+[[upstream]]
+url = "`+upstream.URL+`"
+flush_interval = "10ms"
+`)
+	defer os.Remove(path)
+	opts := NewOptions()
+	opts.UpstreamsFile = path
+	server := newStreamingTestProxy(t, opts, upstream.URL, &bytes.Buffer{})
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Cookie", sessionCookie(t, server))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		assert.Equal(t, "data: first\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first event wasn't flushed")
+	}
+}